@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -31,19 +33,32 @@ import (
 // - option to print all allow/disallow possibilities?
 
 var (
-	app = kingpin.New("gotailwindcss", "Go+TailwindCSS tools")
-	v   = app.Flag("verbose", "Print verbose output").Short('v').Bool()
+	app        = kingpin.New("gotailwindcss", "Go+TailwindCSS tools")
+	v          = app.Flag("verbose", "Print verbose output").Short('v').Bool()
+	j          = app.Flag("jobs", "Number of files to purge scan in parallel, 0 means one per CPU").Short('j').Default("0").Int()
+	excl       = app.Flag("exclude", "Pattern (.gitignore syntax) of files/dirs to skip during purge scan, in addition to .git and node_modules").Strings()
+	ignoreFile = app.Flag("ignorefile", "Name of .gitignore-style files to read from each dir during purge scan").Default(".gitignore").Strings()
+	maxSize    = app.Flag("maxsize", "Skip files larger than this many bytes during purge scan, 0 means no limit").Default("1048576").Int64()
+	symlinks   = app.Flag("symlinks", "Follow symbolic links to dirs during purge scan").Bool()
 
 	build          = app.Command("build", "Build CSS output")
 	buildOutput    = build.Flag("output", "Output file name, use hyphen for stdout").Short('o').Default("-").String()
 	buildPurgescan = build.Flag("purgescan", "Scan file/folder recursively for purge keys").String()
-	buildPurgeext  = build.Flag("purgeext", "Comma separated list of file extensions (no periods) to scan for purge keys").Default("html,vue,jsx,vugu").String()
+	buildPurgeext  = build.Flag("purgeext", "Comma separated list of file extensions (no periods) to scan for purge keys").Default("html,vue,jsx,vugu,gohtml,gotmpl,tmpl").String()
+	buildPurgekeys = build.Flag("purgekeys", "Comma separated list of purge key files (.txt, .json, .go or .twks, as written by purgescan) to merge and use as purge keys").String()
+	buildPurgedyn  = build.Flag("purgedynamic", "Keep all rules matching dynamic classes found during purge scan, e.g. bg-{{.Color}}-500 keeps bg-*-500").Bool()
+	buildSafelist  = build.Flag("safelist", "File with keys, globs (bg-*-500) or /regexps/ which are never purged, one per line").Strings()
+	buildBlocklist = build.Flag("blocklist", "File with keys, globs (bg-*-500) or /regexps/ which are always purged, one per line").Strings()
 	buildInput     = build.Arg("input", "Input file name(s)").Strings()
 
 	purgescan       = app.Command("purgescan", "Perform a purge scan of one or more files/dirs and output the purge keys found")
-	purgescanExt    = build.Flag("ext", "Comma separated list of file extensions (no periods) to scan for purge keys").Default("html,vue,jsx,vugu").String()
-	purgescanOutput = purgescan.Flag("output", "Output file name - extension can be .go, .txt or .json and determines format").Short('o').Default("-").String()
+	purgescanExt    = purgescan.Flag("ext", "Comma separated list of file extensions (no periods) to scan for purge keys").Default("html,vue,jsx,vugu,gohtml,gotmpl,tmpl").String()
+	purgescanOutput = purgescan.Flag("output", "Output file name - extension can be .go, .txt, .json or .twks (binary key set) and determines format").Short('o').Default("-").String()
+	purgescanFormat = purgescan.Flag("format", "Output format, overrides output file extension: go, txt, json, keyset, occurrences (where each key was found) or occurrences-json").Enum("go", "txt", "json", "keyset", "occurrences", "occurrences-json")
 	purgescanNogen  = purgescan.Flag("nogen", "For .go output, do not emit a //go:generate line").Bool()
+	purgescanDyn    = purgescan.Flag("dynamic", "Keep all rules matching dynamic classes found, e.g. bg-{{.Color}}-500 keeps bg-*-500").Bool()
+	purgescanSafe   = purgescan.Flag("safelist", "File with keys, globs (bg-*-500) or /regexps/ to always include in the output, one per line").Strings()
+	purgescanBlock  = purgescan.Flag("blocklist", "File with keys, globs (bg-*-500) or /regexps/ to never include in the output, one per line").Strings()
 	purgescanInput  = purgescan.Arg("input", "Input files/dirs").Strings()
 
 	// serve
@@ -100,6 +115,8 @@ func runBuild() {
 
 	conv := tailwind.New(w, dist)
 
+	var checker twpurge.Checker
+
 	if *buildPurgescan != "" {
 		if *v {
 			log.Printf("Performing purge scan on: %s", *buildPurgescan)
@@ -115,15 +132,48 @@ func runBuild() {
 		if err != nil {
 			log.Fatal(err)
 		}
+		pscanner.SetDynamicFunc(warnDynamic)
+		pscanner.SetWalkOptions(walkOptions())
+		pscanner.SetKeepDynamic(*buildPurgedyn)
 
-		err = filepath.Walk(*buildPurgescan, pscanner.WalkFunc(func(fn string) bool {
+		err = pscanner.WalkParallel(context.Background(), *j, func(fn string) bool {
 			return extMap[filepath.Ext(fn)]
-		}))
+		}, *buildPurgescan)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		conv.SetPurgeChecker(pscanner.Map())
+		checker = pscanner.Map()
+	}
+
+	if *buildPurgekeys != "" {
+		m := make(twpurge.Map)
+		if pm, ok := checker.(twpurge.Map); ok {
+			m.Merge(pm)
+		}
+		for _, fpath := range strings.Split(*buildPurgekeys, ",") {
+			if *v {
+				log.Printf("Reading purge keys: %s", fpath)
+			}
+			km, err := twpurge.ReadKeysFile(strings.TrimSpace(fpath))
+			if err != nil {
+				log.Fatal(err)
+			}
+			m.Merge(km)
+		}
+		checker = m
+	}
+
+	if len(*buildSafelist) > 0 || len(*buildBlocklist) > 0 {
+		checker = &twpurge.ListChecker{
+			Checker:   checker,
+			Safelist:  readLists(*buildSafelist),
+			Blocklist: readLists(*buildBlocklist),
+		}
+	}
+
+	if checker != nil {
+		conv.SetPurgeChecker(checker)
 	}
 
 	for _, inPath := range *buildInput {
@@ -155,7 +205,17 @@ func runPurgescan() {
 		log.Printf("Starting purge scan...")
 	}
 
-	outExt := filepath.Ext(*purgescanOutput)
+	format := *purgescanFormat
+	if format == "" {
+		switch ext := filepath.Ext(*purgescanOutput); ext {
+		case ".go", ".json":
+			format = ext[1:]
+		case ".twks":
+			format = "keyset"
+		default:
+			format = "txt"
+		}
+	}
 
 	w := mkout(*purgescanOutput)
 	defer w.Close()
@@ -170,23 +230,42 @@ func runPurgescan() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	pscanner.SetDynamicFunc(warnDynamic)
+	pscanner.SetWalkOptions(walkOptions())
+	pscanner.SetKeepDynamic(*purgescanDyn)
+	pscanner.SetRecordOccurrences(strings.HasPrefix(format, "occurrences"))
+
+	err = pscanner.WalkParallel(context.Background(), *j, func(fn string) bool {
+		return extMap[filepath.Ext(fn)]
+	}, *purgescanInput...)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	for _, in := range *purgescanInput {
-		err = filepath.Walk(in, pscanner.WalkFunc(func(fn string) bool {
-			return extMap[filepath.Ext(fn)]
-		}))
+	m := pscanner.Map()
+
+	if len(*purgescanSafe) > 0 {
+		ruleNames, err := twpurge.PurgeKeysFromDist(dist)
 		if err != nil {
 			log.Fatal(err)
 		}
+		m.Merge(readLists(*purgescanSafe).MatchKeys(ruleNames))
+	}
+	if len(*purgescanBlock) > 0 {
+		blocklist := readLists(*purgescanBlock)
+		for k := range m {
+			if blocklist.Match(k) {
+				delete(m, k)
+			}
+		}
 	}
 
-	m := pscanner.Map()
 	mk := mkeys(m)
 
 	pkgName := "test123"
 
-	switch outExt {
-	case ".go":
+	switch format {
+	case "go":
 
 		fmt.Fprintf(w, `package %s`+"\n", pkgName)
 		fmt.Fprintf(w, "\n")
@@ -196,16 +275,42 @@ func runPurgescan() {
 			fmt.Fprintf(w, "//go:generate gotailwindcss -o %s %s\n", *purgescanOutput, strings.Join(*purgescanInput, " "))
 			fmt.Fprintf(w, "\n")
 		}
-		fmt.Fprintf(w, "// PurgeKeyMap is a list of keys which should not be purged from CSS output.\n")
-		fmt.Fprintf(w, "var PurgeKeyMap = %#v\n", (map[string]struct{})(m))
+		fmt.Fprintf(w, "import (\n")
+		fmt.Fprintf(w, "\t\"sync\"\n")
+		fmt.Fprintf(w, "\n")
+		fmt.Fprintf(w, "\t\"github.com/gotailwindcss/tailwind/twpurge\"\n")
+		fmt.Fprintf(w, ")\n")
+		fmt.Fprintf(w, "\n")
+		fmt.Fprintf(w, "// PurgeKeySet is the set of keys which should not be purged from CSS output, it implements twpurge.Checker.\n")
+		fmt.Fprintf(w, "var PurgeKeySet = twpurge.MustParseKeySet(purgeKeySetData)\n")
+		fmt.Fprintf(w, "\n")
+		fmt.Fprintf(w, "var (\n")
+		fmt.Fprintf(w, "\tpurgeKeyMapOnce sync.Once\n")
+		fmt.Fprintf(w, "\tpurgeKeyMap     map[string]struct{}\n")
+		fmt.Fprintf(w, ")\n")
 		fmt.Fprintf(w, "\n")
+		fmt.Fprintf(w, "// PurgeKeyMap returns the keys of PurgeKeySet as a map, for code that needs one.\n")
+		fmt.Fprintf(w, "// It is built the first time it is called, and is shared so must not be modified.\n")
+		fmt.Fprintf(w, "func PurgeKeyMap() map[string]struct{} {\n")
+		fmt.Fprintf(w, "\tpurgeKeyMapOnce.Do(func() {\n")
+		fmt.Fprintf(w, "\t\tpurgeKeyMap = PurgeKeySet.Map()\n")
+		fmt.Fprintf(w, "\t})\n")
+		fmt.Fprintf(w, "\treturn purgeKeyMap\n")
+		fmt.Fprintf(w, "}\n")
+		fmt.Fprintf(w, "\n")
+		fmt.Fprintf(w, "const purgeKeySetData = %q\n", twpurge.NewKeySet(m).Bytes())
 
-	case ".txt":
+	case "keyset":
+		if _, err := w.Write(twpurge.NewKeySet(m).Bytes()); err != nil {
+			log.Fatal(err)
+		}
+
+	case "txt":
 		for _, k := range mk {
 			fmt.Fprintln(w, k)
 		}
 
-	case ".json":
+	case "json":
 		fmt.Fprintf(w, "[\n")
 		for i := 0; i < len(mk); i++ {
 			k := mk[i]
@@ -217,10 +322,80 @@ func runPurgescan() {
 		}
 		fmt.Fprintf(w, "]\n")
 
+	case "occurrences":
+		idx := pscanner.OccurrenceIndex()
+		for _, k := range mk {
+			occs := idx[k]
+			if len(occs) == 0 {
+				fmt.Fprintf(w, "%s\t(safelist)\n", k)
+			}
+			for _, o := range occs {
+				fmt.Fprintf(w, "%s\t%s:%d:%d", k, o.Name, o.Line, o.Col)
+				if o.Pattern != "" {
+					fmt.Fprintf(w, "\t(dynamic %s)", o.Pattern)
+				}
+				fmt.Fprintf(w, "\n")
+			}
+		}
+
+	case "occurrences-json":
+		idx := pscanner.OccurrenceIndex()
+		out := make(map[string][]twpurge.Occurrence, len(mk))
+		for _, k := range mk {
+			out[k] = idx[k]
+			if out[k] == nil {
+				out[k] = []twpurge.Occurrence{} // safelisted
+			}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(out); err != nil {
+			log.Fatal(err)
+		}
+
 	}
 
 }
 
+// readLists reads and combines safelist/blocklist files, returns nil if none
+func readLists(fpaths []string) *twpurge.List {
+	if len(fpaths) == 0 {
+		return nil
+	}
+	ret := &twpurge.List{}
+	for _, fpath := range fpaths {
+		if *v {
+			log.Printf("Reading list: %s", fpath)
+		}
+		f, err := os.Open(fpath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = ret.AddFrom(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("%s: %v", fpath, err)
+		}
+	}
+	return ret
+}
+
+// walkOptions returns the purge scan walk options from the command line flags
+func walkOptions() twpurge.WalkOptions {
+	return twpurge.WalkOptions{
+		Exclude:        append(append([]string(nil), twpurge.DefaultExclude...), *excl...),
+		IgnoreFiles:    *ignoreFile,
+		MaxFileSize:    *maxSize,
+		SkipBinary:     true,
+		FollowSymlinks: *symlinks,
+	}
+}
+
+// warnDynamic prints a warning for a class built by interpolation, which purging may break
+func warnDynamic(d twpurge.Dynamic) {
+	log.Printf("WARNING: %v", d)
+}
+
 func mkout(outpath string) io.WriteCloser {
 
 	var ret io.WriteCloser
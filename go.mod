@@ -1,12 +1,15 @@
 module github.com/gotailwindcss/tailwind
 
-go 1.14
+go 1.17
 
 require (
-	github.com/alecthomas/template v0.0.0-20190718012654-fb15b899a751 // indirect
-	github.com/alecthomas/units v0.0.0-20190924025748-f65c72e2690d // indirect
 	github.com/cespare/xxhash v1.1.0
 	github.com/tdewolff/minify/v2 v2.9.0
 	github.com/tdewolff/parse/v2 v2.5.0
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
 )
+
+require (
+	github.com/alecthomas/template v0.0.0-20190718012654-fb15b899a751 // indirect
+	github.com/alecthomas/units v0.0.0-20190924025748-f65c72e2690d // indirect
+)
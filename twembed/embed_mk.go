@@ -52,7 +52,7 @@ func main() {
 		panic(err)
 	}
 
-	fmt.Fprintf(out, "var twPurgeKeyMap = %#v\n\n", pkm)
+	fmt.Fprintf(out, "const twPurgeKeySet = %q\n\n", twpurge.NewKeySet(pkm).Bytes())
 
 	// var b []byte
 
@@ -5,6 +5,9 @@ import (
 	"io"
 	"io/ioutil"
 	"strings"
+	"sync"
+
+	"github.com/gotailwindcss/tailwind/twpurge"
 )
 
 //go:generate go run embed_mk.go
@@ -40,7 +43,23 @@ func (d Dist) OpenDist(name string) (io.ReadCloser, error) {
 
 }
 
+var purgeKeySet = twpurge.MustParseKeySet(twPurgeKeySet)
+
+// PurgeKeySet returns the set of all of the possible keys that can be purged.
+func (d Dist) PurgeKeySet() *twpurge.KeySet {
+	return purgeKeySet
+}
+
+var (
+	purgeKeyMapOnce sync.Once
+	purgeKeyMap     map[string]struct{}
+)
+
 // PurgeKeyMap returns a map of all of the possible keys that can be purged.
+// It is built from PurgeKeySet the first time it is called, and is shared so must not be modified.
 func (d Dist) PurgeKeyMap() map[string]struct{} {
-	return twPurgeKeyMap
+	purgeKeyMapOnce.Do(func() {
+		purgeKeyMap = purgeKeySet.Map()
+	})
+	return purgeKeyMap
 }
@@ -0,0 +1,36 @@
+package twhandler
+
+import (
+	"path"
+
+	"github.com/gotailwindcss/tailwind"
+)
+
+// Bundle is a CSS file served by the Handler which is the output of converting several input
+// files together, in order, e.g. vendor CSS followed by the application's, so a page can get
+// both with one request.  The output is cached like that of other files and is regenerated
+// when any of the input files change.
+type Bundle struct {
+	Name  string   // path served under the Handler's path prefix, e.g. "all.css"
+	Files []string // paths of the input files within the Handler's file system, e.g. "vendor.css"
+
+	// PurgeChecker, if not nil, is used to purge the Bundle's output instead of any set by the
+	// Handler's converter func.  If it is also a Dependency (e.g. a twpurge.DirChecker), the
+	// output is regenerated when its version changes, and if it has a Map method returning a
+	// twpurge.Map each conversion purges against a snapshot of its keys taken with it.
+	PurgeChecker tailwind.PurgeChecker
+}
+
+// AddBundle adds a Bundle, which is served in place of any file in the file system with the same name.
+// Bundles should be added before the Handler is used.
+func (h *Handler) AddBundle(b Bundle) {
+	files := make([]string, len(b.Files))
+	for i, fp := range b.Files {
+		files[i] = path.Clean("/" + fp)
+	}
+	b.Files = files
+	if h.bundles == nil {
+		h.bundles = make(map[string]Bundle)
+	}
+	h.bundles[path.Clean("/"+b.Name)] = b
+}
@@ -0,0 +1,146 @@
+package twhandler
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Default cache limits, see SetCacheLimits.
+const (
+	DefaultCacheMaxEntries = 1024
+	DefaultCacheMaxBytes   = 64 << 20
+)
+
+// CacheStats describes the state of a Handler's cache, see Handler.CacheStats.
+type CacheStats struct {
+	Entries        int           // number of outputs cached
+	Bytes          int64         // approximate memory used by the cached outputs, including encoded variants
+	Hits           uint64        // requests served from the cache
+	Misses         uint64        // requests which required a conversion (including waiting for one in progress)
+	Evictions      uint64        // entries removed to stay within the limits
+	LastConversion time.Duration // how long the most recent conversion took
+}
+
+// lruCache holds the output for each path, evicting the least recently used entries
+// to stay within the limits.  It is safe for concurrent use.
+type lruCache struct {
+	mu         sync.Mutex
+	maxEntries int   // 0 means no limit
+	maxBytes   int64 // 0 means no limit
+	ll         *list.List
+	m          map[string]*list.Element
+	stats      CacheStats
+}
+
+type lruEntry struct {
+	key   string
+	value cacheValue
+	size  int64
+}
+
+func newLRUCache(maxEntries int, maxBytes int64) *lruCache {
+	return &lruCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		ll:         list.New(),
+		m:          make(map[string]*list.Element),
+	}
+}
+
+// get returns the entry for key and marks it as recently used
+func (c *lruCache) get(key string) (cacheValue, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.m[key]
+	if !ok {
+		return cacheValue{}, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*lruEntry).value, true
+}
+
+// put adds or replaces the entry for key, an entry too large for the cache is not added
+func (c *lruCache) put(key string, value cacheValue) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeElement(c.m[key])
+
+	ent := &lruEntry{key: key, value: value, size: value.memSize()}
+	if c.maxBytes > 0 && ent.size > c.maxBytes {
+		return
+	}
+	c.m[key] = c.ll.PushFront(ent)
+	c.stats.Bytes += ent.size
+	c.stats.Entries++
+
+	c.evict()
+}
+
+// remove removes the entry for key, if any
+func (c *lruCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeElement(c.m[key])
+}
+
+// purge removes every entry
+func (c *lruCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	c.m = make(map[string]*list.Element)
+	c.stats.Entries, c.stats.Bytes = 0, 0
+}
+
+func (c *lruCache) removeElement(e *list.Element) {
+	if e == nil {
+		return
+	}
+	ent := c.ll.Remove(e).(*lruEntry)
+	delete(c.m, ent.key)
+	c.stats.Bytes -= ent.size
+	c.stats.Entries--
+}
+
+// setLimits changes the limits, evicting entries as needed
+func (c *lruCache) setLimits(maxEntries int, maxBytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxEntries, c.maxBytes = maxEntries, maxBytes
+	c.evict()
+}
+
+// evict removes the least recently used entries until the cache is within its limits
+func (c *lruCache) evict() {
+	for (c.maxEntries > 0 && c.stats.Entries > c.maxEntries) || (c.maxBytes > 0 && c.stats.Bytes > c.maxBytes) {
+		c.removeElement(c.ll.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *lruCache) countHit() {
+	c.mu.Lock()
+	c.stats.Hits++
+	c.mu.Unlock()
+}
+
+func (c *lruCache) countMiss() {
+	c.mu.Lock()
+	c.stats.Misses++
+	c.mu.Unlock()
+}
+
+func (c *lruCache) setLastConversion(d time.Duration) {
+	c.mu.Lock()
+	c.stats.LastConversion = d
+	c.mu.Unlock()
+}
+
+func (c *lruCache) getStats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
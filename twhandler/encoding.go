@@ -0,0 +1,158 @@
+package twhandler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// encoding is a content encoding the Handler can produce
+type encoding struct {
+	name      string
+	newWriter func(w io.Writer) io.WriteCloser
+}
+
+func newGzipWriter(w io.Writer) io.WriteCloser {
+	gw, _ := gzip.NewWriterLevel(w, gzip.BestCompression) // level is valid
+	return gw
+}
+
+// SetEncoding registers a content encoding (as used in Accept-Encoding, e.g. "br") which output can
+// be served in.  When caching is enabled, each output is encoded once with every registered encoding
+// and the results are cached alongside it.  Passing a nil func removes the encoding.
+// By default "gzip" is registered.  Brotli can be added with e.g. github.com/andybalholm/brotli:
+//
+//	h.SetEncoding("br", func(w io.Writer) io.WriteCloser {
+//		return brotli.NewWriterLevel(w, brotli.BestCompression)
+//	})
+//
+// The encoding is chosen from those the request accepts, preferring the highest quality value
+// and then the smallest result.  An encoding is not used if it does not make the output smaller.
+// When caching is disabled output is not encoded, since it would have to be encoded for every
+// request, use SetWriteCloserFunc for that.
+func (h *Handler) SetEncoding(name string, newWriter func(w io.Writer) io.WriteCloser) {
+	for i, e := range h.encodings {
+		if e.name == name {
+			h.encodings = append(h.encodings[:i], h.encodings[i+1:]...)
+			break
+		}
+	}
+	if newWriter != nil {
+		h.encodings = append(h.encodings, encoding{name: name, newWriter: newWriter})
+	}
+}
+
+// encodeAll returns content encoded with each encoding, only those smaller than content are included
+func (h *Handler) encodeAll(content string) (map[string]string, error) {
+	ret := make(map[string]string, len(h.encodings))
+	for _, e := range h.encodings {
+		b, err := encode(e, content)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) < len(content) {
+			ret[e.name] = b
+		}
+	}
+	return ret, nil
+}
+
+func encode(e encoding, content string) (string, error) {
+	var buf bytes.Buffer
+	wc := e.newWriter(&buf)
+	if _, err := io.WriteString(wc, content); err != nil {
+		wc.Close()
+		return "", err
+	}
+	if err := wc.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// negotiate returns the name of the encoding to use for content, or "" for identity, from those in encoded.
+func (h *Handler) negotiate(r *http.Request, content string, encoded map[string]string) (string, string) {
+
+	if len(encoded) == 0 {
+		return "", content
+	}
+	accept := parseAcceptEncoding(r.Header.Get("Accept-Encoding"))
+	if len(accept) == 0 {
+		return "", content
+	}
+
+	bestName, best, bestQ := "", content, accept.q("identity")
+	for _, e := range h.encodings {
+		q := accept.q(e.name)
+		if q <= 0 || q < bestQ {
+			continue
+		}
+		b, ok := encoded[e.name]
+		if !ok {
+			continue
+		}
+		if q > bestQ || len(b) < len(best) {
+			bestName, best, bestQ = e.name, b, q
+		}
+	}
+	// if identity was refused but nothing else is available it is sent anyway (RFC 7231 5.3.4)
+	return bestName, best
+}
+
+// acceptEncoding is the quality value of each coding in an Accept-Encoding header
+type acceptEncoding map[string]float64
+
+func parseAcceptEncoding(s string) acceptEncoding {
+	ret := make(acceptEncoding)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, q := part, 1.0
+		if i := strings.IndexByte(part, ';'); i >= 0 {
+			name = strings.TrimSpace(part[:i])
+			for _, param := range strings.Split(part[i+1:], ";") {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") || strings.HasPrefix(param, "Q=") {
+					if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+						q = v
+					}
+				}
+			}
+		}
+		ret[strings.ToLower(name)] = q
+	}
+	return ret
+}
+
+// q returns the quality value for coding
+func (a acceptEncoding) q(coding string) float64 {
+	if q, ok := a[coding]; ok {
+		return q
+	}
+	if q, ok := a["*"]; ok {
+		return q
+	}
+	if coding == "identity" {
+		return 0.001 // acceptable unless refused, but anything explicitly listed is preferred
+	}
+	return 0
+}
+
+// encodingResponseWriter adds the Content-Encoding header when a successful response is written,
+// so http.ServeContent still sets Content-Length (which it omits if Content-Encoding is already set)
+type encodingResponseWriter struct {
+	http.ResponseWriter
+	encoding string
+}
+
+func (w *encodingResponseWriter) WriteHeader(code int) {
+	if code == http.StatusOK || code == http.StatusPartialContent || code == http.StatusNotModified {
+		w.Header().Set("Content-Encoding", w.encoding)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
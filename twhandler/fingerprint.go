@@ -0,0 +1,65 @@
+package twhandler
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// fingerprintLen is the number of hex digits of the output hash in a fingerprinted file name
+const fingerprintLen = 16
+
+// URL returns the fingerprinted URL of the CSS file name (relative to the path prefix, e.g. "main.css"),
+// which includes the hash of the current output, e.g. "/css/main.0123456789abcdef.css".  The Handler
+// serves such URLs with a Cache-Control header allowing them to be cached for a year (unless already
+// set), since the URL changes with the output.  A request with a fingerprint which is no longer current
+// is redirected to the current URL.  The file is processed if its output is not already cached.
+func (h *Handler) URL(name string) (string, error) {
+	p := path.Clean("/" + name)
+	cv, _, err := h.output(context.Background(), p, h.pathPrefix+p)
+	if err != nil {
+		return "", err
+	}
+	return h.pathPrefix + fingerprintName(p, cv.hash), nil
+}
+
+// FuncMap returns functions for use with html/template, currently "twcss" which calls URL, e.g.
+//
+//	<link rel="stylesheet" href="{{ twcss "main.css" }}">
+func (h *Handler) FuncMap() template.FuncMap {
+	return template.FuncMap{
+		"twcss": h.URL,
+	}
+}
+
+// serveStaleFingerprint redirects to the current fingerprinted URL for p
+func (h *Handler) serveStaleFingerprint(w http.ResponseWriter, r *http.Request, p string, cv cacheValue) {
+	w.Header().Set("Cache-Control", "no-cache")
+	http.Redirect(w, r, h.pathPrefix+fingerprintName(p, cv.hash), http.StatusFound)
+}
+
+// fingerprintName inserts the hash before the extension of name
+func fingerprintName(name string, hash uint64) string {
+	ext := path.Ext(name)
+	return fmt.Sprintf("%s.%0*x%s", strings.TrimSuffix(name, ext), fingerprintLen, hash, ext)
+}
+
+// splitFingerprint returns name without its fingerprint and the fingerprint, or name and "" if it has none
+func splitFingerprint(name string) (string, string) {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	i := strings.LastIndexByte(base, '.')
+	if i < 0 || len(base)-i-1 != fingerprintLen || strings.LastIndexByte(base, '/') > i {
+		return name, ""
+	}
+	fp := base[i+1:]
+	for _, c := range fp {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return name, ""
+		}
+	}
+	return base[:i] + ext, fp
+}
@@ -0,0 +1,55 @@
+package twhandler
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// flightGroup collapses concurrent calls for the same key into one, so simultaneous cache misses
+// for a path only run one conversion
+type flightGroup struct {
+	mu sync.Mutex
+	m  map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	val  cacheValue
+	err  error
+}
+
+var errFlightPanic = errors.New("twhandler: processing panicked")
+
+// do calls fn for key unless a call for key is already in flight, in which case it waits for that
+// call's result, or for ctx to be done and returns ctx.Err().
+func (g *flightGroup) do(ctx context.Context, key string, fn func() (cacheValue, error)) (cacheValue, error) {
+
+	g.mu.Lock()
+	if c, ok := g.m[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-c.done:
+			return c.val, c.err
+		case <-ctx.Done():
+			return cacheValue{}, ctx.Err()
+		}
+	}
+	c := &flightCall{done: make(chan struct{})}
+	if g.m == nil {
+		g.m = make(map[string]*flightCall)
+	}
+	g.m[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.m, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+
+	c.err = errFlightPanic // what waiters get if fn panics
+	c.val, c.err = fn()
+	return c.val, c.err
+}
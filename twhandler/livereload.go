@@ -0,0 +1,185 @@
+package twhandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cespare/xxhash"
+)
+
+// LiveReloadPath and LiveReloadScriptPath are appended to the Handler's path prefix to
+// get the paths of the live reload endpoints, see SetLiveReload.
+const (
+	LiveReloadPath       = "/_livereload"
+	LiveReloadScriptPath = "/_livereload.js"
+)
+
+type liveReload struct {
+	interval time.Duration
+}
+
+// SetLiveReload enables live reload for development.  The Handler then also serves a script at
+// prefix+LiveReloadScriptPath, to be included in pages with e.g.
+//
+//	<script src="/css/_livereload.js"></script>
+//
+// which connects to prefix+LiveReloadPath using Server-Sent Events and, when the output for
+// any stylesheet the page links to under the prefix changes, swaps the <link> for one with the
+// new URL, without reloading the page.  The size and mod time of the input files of each stylesheet,
+// and the version of each Dependency (see AddDependency), are checked every interval (a second if
+// interval is zero or less), and only when they change is the output looked at, from the cache if
+// enabled.  Passing a negative interval disables live reload.
+func (h *Handler) SetLiveReload(interval time.Duration) {
+	if interval < 0 {
+		h.liveReload = nil
+		return
+	}
+	if interval == 0 {
+		interval = time.Second
+	}
+	h.liveReload = &liveReload{interval: interval}
+}
+
+// serveLiveReload serves the live reload endpoints, returns false if r is not for one of them
+func (h *Handler) serveLiveReload(w http.ResponseWriter, r *http.Request) bool {
+	switch r.URL.Path {
+	case h.pathPrefix + LiveReloadScriptPath:
+		w.Header().Set("Content-Type", "application/javascript")
+		w.Header().Set("Cache-Control", "no-cache")
+		fmt.Fprintf(w, liveReloadScript, jsonString(h.pathPrefix), jsonString(h.pathPrefix+LiveReloadPath))
+		return true
+	case h.pathPrefix + LiveReloadPath:
+		h.serveLiveReloadEvents(w, r)
+		return true
+	}
+	return false
+}
+
+// serveLiveReloadEvents sends a "change" event, with the path and ETag as JSON, each time the output
+// for one of the paths in the "path" query parameters changes
+func (h *Handler) serveLiveReloadEvents(w http.ResponseWriter, r *http.Request) {
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", 500)
+		return
+	}
+
+	var paths []string
+	for _, p := range r.URL.Query()["path"] {
+		if strings.HasPrefix(p, h.pathPrefix+"/") {
+			paths = append(paths, p)
+		}
+	}
+	if len(paths) == 0 {
+		http.Error(w, "no stylesheet paths under "+h.pathPrefix+" given", 400)
+		return
+	}
+
+	ctx := r.Context()
+
+	// current returns the version of the output for paths[i], an error counts as a version so recovering
+	// from it is noticed.  The output is only looked at if the stamp changed since the last call.
+	versions := make([]string, len(paths))
+	stamps := make([]uint64, len(paths))
+	current := func(i int) string {
+		p := paths[i]
+		up, _ := splitFingerprint(h.cachePath(p))
+		st, racy, err := h.stamp(up)
+		if err == nil && !racy && st == stamps[i] && versions[i] != "" {
+			return versions[i]
+		}
+		stamps[i] = st
+		cv, _, err := h.output(ctx, up, p)
+		if err != nil {
+			return fmt.Sprintf("error-%016x", xxhash.Sum64String(err.Error()))
+		}
+		return fmt.Sprintf("%016x", cv.hash)
+	}
+
+	for i := range paths {
+		versions[i] = current(i)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintf(w, "retry: %d\n\n", h.liveReload.interval.Milliseconds())
+	flusher.Flush()
+
+	ticker := time.NewTicker(h.liveReload.interval)
+	defer ticker.Stop()
+	lastWrite := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for i, p := range paths {
+			v := current(i)
+			if ctx.Err() != nil {
+				return
+			}
+			if v == versions[i] {
+				continue
+			}
+			versions[i] = v
+			if strings.HasPrefix(v, "error-") && !h.errorOverlay {
+				continue // swapping in a stylesheet which fails would only unstyle the page
+			}
+			b, _ := json.Marshal(map[string]string{"path": p, "etag": v})
+			fmt.Fprintf(w, "event: change\ndata: %s\n\n", b)
+			lastWrite = time.Now()
+		}
+
+		if time.Since(lastWrite) > 15*time.Second { // keep the connection from idling out
+			fmt.Fprintf(w, ": ping\n\n")
+			lastWrite = time.Now()
+		}
+		flusher.Flush()
+	}
+}
+
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// liveReloadScript is formatted with the path prefix and the events path, as JSON strings
+const liveReloadScript = `(function() {
+	var prefix = %s, eventsPath = %s;
+	function links() {
+		return Array.prototype.filter.call(document.querySelectorAll('link[rel~="stylesheet"]'), function(l) {
+			return new URL(l.href, location.href).pathname.indexOf(prefix + "/") === 0;
+		});
+	}
+	function connect() {
+		var paths = links().map(function(l) { return new URL(l.href, location.href).pathname; });
+		if (!paths.length) { return; }
+		var es = new EventSource(eventsPath + "?" + paths.map(function(p) { return "path=" + encodeURIComponent(p); }).join("&"));
+		es.addEventListener("change", function(e) {
+			var d = JSON.parse(e.data);
+			links().forEach(function(l) {
+				var u = new URL(l.href, location.href);
+				if (u.pathname !== d.path) { return; }
+				u.searchParams.set("v", d.etag);
+				var nl = l.cloneNode();
+				nl.href = u.toString();
+				// remove the old stylesheet once the new one has loaded, so the page does not flash
+				nl.onload = nl.onerror = function() { l.remove(); };
+				l.parentNode.insertBefore(nl, l.nextSibling);
+			});
+		});
+	}
+	if (document.readyState === "loading") {
+		document.addEventListener("DOMContentLoaded", connect);
+	} else {
+		connect();
+	}
+})();
+`
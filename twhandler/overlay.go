@@ -0,0 +1,114 @@
+package twhandler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/tdewolff/parse/v2"
+)
+
+// SetErrorOverlay with true enables a development mode where, instead of a plain text 500 response
+// which the browser ignores, errors processing a file are served as a valid stylesheet which shows
+// the error (file, line and message) over the top of the page.  Other errors, such as a file not
+// being found, keep their status.  The response has status 200 so the browser applies
+// it, with Cache-Control "no-store" so it is not kept once the error is fixed.
+// Do not enable this in production, since it shows error details to visitors.
+func (h *Handler) SetErrorOverlay(enabled bool) {
+	h.errorOverlay = enabled
+}
+
+// SetErrorFunc assigns a function which is called with each error responded to, e.g. for logging.
+// It is called whether or not the error overlay is enabled.
+func (h *Handler) SetErrorFunc(f func(r *http.Request, err error)) {
+	h.errorFunc = f
+}
+
+// serveError responds with err, as an error overlay stylesheet if enabled and code is 500
+func (h *Handler) serveError(w http.ResponseWriter, r *http.Request, err error, code int) {
+
+	if h.errorFunc != nil {
+		h.errorFunc(r, err)
+	}
+
+	if !h.errorOverlay || code != 500 {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(200)
+	fmt.Fprint(w, errorOverlayCSS(r.URL.Path, err))
+}
+
+// errorOverlayCSS returns a stylesheet which displays err for the file name at the top of the page
+func errorOverlayCSS(name string, err error) string {
+
+	msg := err.Error()
+	var pe *parse.Error
+	if errors.As(err, &pe) {
+		msg = fmt.Sprintf("%s:%d:%d: %s\n\n%s", parseErrorFile(err, pe, name), pe.Line, pe.Column, pe.Message, strings.Trim(pe.Context, "\n"))
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "/* twhandler: error processing %s */\n", strings.ReplaceAll(name, "*/", "* /"))
+	sb.WriteString("body::before {\n")
+	fmt.Fprintf(&sb, "\tcontent: %s;\n", cssString("Error in "+name+"\n\n"+msg))
+	sb.WriteString(`	display: block;
+	position: fixed;
+	z-index: 2147483647;
+	top: 0;
+	left: 0;
+	right: 0;
+	max-height: 100vh;
+	overflow: auto;
+	box-sizing: border-box;
+	margin: 0;
+	padding: 1em 1.5em;
+	white-space: pre-wrap;
+	font: 14px/1.5 ui-monospace, SFMono-Regular, Menlo, Consolas, monospace;
+	color: #7f1d1d;
+	background: #fef2f2;
+	border-bottom: 4px solid #dc2626;
+	box-shadow: 0 2px 8px rgba(0, 0, 0, 0.3);
+}
+`)
+	return sb.String()
+}
+
+// cssString quotes s as a CSS string, with newlines as line breaks
+func cssString(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, c := range s {
+		switch {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteRune(c)
+		case c == '\n':
+			sb.WriteString(`\A `)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&sb, `\%X `, c)
+		default:
+			sb.WriteRune(c)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// parseErrorFile returns the name of the input file which pe is for, which the Converter prefixes
+// to it, or name if not found (the input files of a Bundle each have their own name)
+func parseErrorFile(err error, pe *parse.Error, name string) string {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if errors.Unwrap(err) == error(pe) {
+			if s := strings.TrimSuffix(err.Error(), ": "+pe.Error()); s != err.Error() {
+				return s
+			}
+			break
+		}
+	}
+	return name
+}
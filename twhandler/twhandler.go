@@ -3,16 +3,21 @@ package twhandler
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/cespare/xxhash"
 	"github.com/gotailwindcss/tailwind"
+	"github.com/gotailwindcss/tailwind/twpurge"
 )
 
 // New returns a Handler. TODO explain args
@@ -29,8 +34,9 @@ func NewFromFunc(fs http.FileSystem, pathPrefix string, converterFunc func(w io.
 		converterFunc: converterFunc,
 		fs:            fs,
 		pathPrefix:    pathPrefix,
-		cache:         make(map[string]cacheValue),
+		cache:         newLRUCache(DefaultCacheMaxEntries, DefaultCacheMaxBytes),
 		headerFunc:    defaultHeaderFunc,
+		encodings:     []encoding{{name: "gzip", newWriter: newGzipWriter}},
 	}
 }
 
@@ -42,10 +48,36 @@ func defaultHeaderFunc(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// // TODO: probably a shorthand that sets up the purger, etc. would make sense
-// // enables purging for all default file types on dir
-// func NewDev(dir, pathPrefix string, dist tailwind.Dist) {
-// }
+// DevRescanInterval is how often a Handler from NewDev checks the markup for changes, at most.
+const DevRescanInterval = time.Second
+
+// NewDev returns a Handler for development which serves CSS files from fs and purges
+// them of the rules not used by the markup in the markup file system, like a production
+// build would.  All files in markup matching twpurge.MatchDefault are scanned (skipping
+// twpurge.DefaultExclude and binary files), and are checked for changes at most every
+// DevRescanInterval, with the cached output regenerated when the keys change.
+// Each conversion purges against a copy of the keys, so its output is from one scan.
+func NewDev(fs http.FileSystem, pathPrefix string, dist tailwind.Dist, markup http.FileSystem) (*Handler, error) {
+
+	scanner, err := twpurge.NewScannerFromDist(dist)
+	if err != nil {
+		return nil, err
+	}
+	scanner.SetWalkOptions(twpurge.WalkOptions{
+		Exclude:    twpurge.DefaultExclude,
+		SkipBinary: true,
+	})
+	checker := twpurge.NewDirChecker(scanner, DevRescanInterval)
+	checker.AddRootHTTPFileSystem(markup, "/", twpurge.MatchDefault)
+
+	h := NewFromFunc(fs, pathPrefix, func(w io.Writer) *tailwind.Converter {
+		ret := tailwind.New(w, dist)
+		ret.SetPurgeChecker(checker.Map())
+		return ret
+	})
+	h.AddDependency(checker)
+	return h, nil
+}
 
 // Handler serves an HTTP response for a CSS file that is process using tailwind.
 type Handler struct {
@@ -55,9 +87,22 @@ type Handler struct {
 	notFound        http.Handler
 	pathPrefix      string
 	writeCloserFunc func(w http.ResponseWriter, r *http.Request) io.WriteCloser
-	cache           map[string]cacheValue
-	rwmu            sync.RWMutex
+	cache           *lruCache // nil if disabled
 	headerFunc      func(w http.ResponseWriter, r *http.Request)
+	deps            []Dependency
+	encodings       []encoding
+	flight          flightGroup
+	liveReload      *liveReload // nil if disabled
+	errorOverlay    bool
+	errorFunc       func(r *http.Request, err error)
+	bundles         map[string]Bundle // by path, with cleaned Files
+}
+
+// Dependency is something other than the input file which the output depends on,
+// such as the purge keys from a twpurge.DirChecker.  Version must return a different
+// value whenever the output needs to be regenerated.
+type Dependency interface {
+	Version() uint64
 }
 
 // SetMaxAge calls SetHeaderFunc with a function that sets the Cache-Control header (if not already set)
@@ -88,13 +133,61 @@ func (h *Handler) SetNotFoundHandler(nfh http.Handler) {
 // SetCache with false will disable the cache.
 func (h *Handler) SetCache(enabled bool) {
 	if enabled {
-		h.cache = make(map[string]cacheValue)
+		h.cache = newLRUCache(DefaultCacheMaxEntries, DefaultCacheMaxBytes)
 	} else {
 		h.cache = nil
 	}
 }
 
-// TODO: be sure to have clear example showing brotli
+// SetCacheLimits sets the maximum number of outputs cached and the maximum number of bytes they
+// (and their encoded variants) may use, zero means no limit.  When a limit is exceeded the least
+// recently used outputs are evicted.  The defaults are DefaultCacheMaxEntries and DefaultCacheMaxBytes.
+// It has no effect if the cache is disabled.
+func (h *Handler) SetCacheLimits(maxEntries int, maxBytes int64) {
+	if h.cache != nil {
+		h.cache.setLimits(maxEntries, maxBytes)
+	}
+}
+
+// Invalidate removes the cached output for the request path p (including the path prefix, e.g.
+// "/css/main.css"), so it is converted again on the next request.
+func (h *Handler) Invalidate(p string) {
+	if h.cache != nil {
+		h.cache.remove(h.cachePath(p))
+	}
+}
+
+// Purge removes all cached output.
+func (h *Handler) Purge() {
+	if h.cache != nil {
+		h.cache.purge()
+	}
+}
+
+// CacheStats returns statistics about the cache, e.g. for export to a metrics system.
+// The zero value is returned if the cache is disabled.
+func (h *Handler) CacheStats() CacheStats {
+	if h.cache == nil {
+		return CacheStats{}
+	}
+	return h.cache.getStats()
+}
+
+// cachePath returns the path within fs for the request path p
+func (h *Handler) cachePath(p string) string {
+	p = path.Clean(p)
+	return path.Clean(strings.TrimPrefix(p, h.pathPrefix))
+}
+
+// AddDependency adds a Dependency of the output, cached output is regenerated when its Version changes.
+// Dependencies should be added before the Handler is used.
+func (h *Handler) AddDependency(d Dependency) {
+	h.deps = append(h.deps, d)
+}
+
+// SetWriteCloserFunc assigns a function which wraps the response writer, e.g. to compress the output.
+// If set it is used instead of the encodings from SetEncoding, which should be preferred since
+// those are cached and this is called for every response.
 func (h *Handler) SetWriteCloserFunc(f func(w http.ResponseWriter, r *http.Request) io.WriteCloser) {
 	h.writeCloserFunc = f
 }
@@ -107,80 +200,43 @@ func (h *Handler) SetWriteCloserFunc(f func(w http.ResponseWriter, r *http.Reque
 // ServeHTTP implements http.Handler.
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
-	p := path.Clean(r.URL.Path)
-	p = path.Clean(strings.TrimPrefix(p, h.pathPrefix))
-
-	f, err := h.fs.Open(p)
-	if err != nil {
-		code := 500
-		if os.IsPermission(err) {
-			code = 403
-		} else if os.IsNotExist(err) {
-			if h.notFound != nil {
-				h.notFound.ServeHTTP(w, r)
-				return
-			}
-			code = 404
-		}
-		http.Error(w, fmt.Sprintf("error opening %s: %v", r.URL.Path, err), code)
+	if h.liveReload != nil && h.serveLiveReload(w, r) {
 		return
 	}
-	defer f.Close()
 
-	w.Header().Set("Content-Type", "text/css")
+	p, fp := splitFingerprint(h.cachePath(r.URL.Path))
 
-	st, err := f.Stat()
+	cv, code, err := h.output(r.Context(), p, r.URL.Path)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("stat failed for %s: %v", r.URL.Path, err), 500)
+		if err == r.Context().Err() { // gave up waiting, client is gone
+			return
+		}
+		if code == 404 && h.notFound != nil {
+			h.notFound.ServeHTTP(w, r)
+			return
+		}
+		h.serveError(w, r, err, code)
 		return
 	}
 
-	if h.headerFunc != nil {
-		h.headerFunc(w, r)
-	}
-
-	if h.cache != nil { // if cache enabled
-		h.rwmu.RLock()
-		cv, ok := h.cache[p]
-		h.rwmu.RUnlock()
-		if ok {
-
-			// if h.check304(w, r, cv) {
-			// 	return
-			// }
-
-			wc := h.makeW(w, r)
-			defer wc.Close()
-
-			// handle 304s properly with ServeContent
-			http.ServeContent(
-				&wwrap{Writer: wc, ResponseWriter: w},
-				r,
-				p,
-				st.ModTime(),
-				strings.NewReader(cv.content),
-			)
+	if fp != "" {
+		if fp != fmt.Sprintf("%0*x", fingerprintLen, cv.hash) {
+			h.serveStaleFingerprint(w, r, p, cv)
 			return
 		}
-
-		cv.content, cv.hash, err = h.process(w, r, f)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("processing failed on %s: %v", r.URL.Path, err), 500)
-			return
+		if w.Header().Get("Cache-Control") == "" {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
 		}
-
-		h.rwmu.Lock()
-		h.cache[p] = cv
-		h.rwmu.Unlock()
-		return
 	}
 
-	_, _, err = h.process(w, r, f)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("processing failed on %s: %v", r.URL.Path, err), 500)
-		return
+	w.Header().Set("Content-Type", "text/css")
+
+	if h.headerFunc != nil {
+		h.headerFunc(w, r)
 	}
 
+	h.serve(w, r, p, cv)
+
 	// // ck := cacheKey{
 	// // 	tsnano: st.ModTime().UnixNano(),
 	// // 	size:   st.Size(),
@@ -196,6 +252,171 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// }
 }
 
+// output returns the output for the file (or Bundle) at p within fs, from the cache if it is enabled and
+// the entry is still valid.  The name (the request path) is used in errors, which are returned
+// with the appropriate HTTP status code.  If ctx is done while waiting for another request's
+// conversion of the same file, ctx.Err() is returned.
+func (h *Handler) output(ctx context.Context, p, name string) (cacheValue, int, error) {
+
+	files, checker, isBundle := h.inputs(p)
+	names := []string{name}
+	if isBundle {
+		names = make([]string, len(files))
+		for i, fp := range files {
+			names[i] = h.pathPrefix + fp
+		}
+	}
+
+	rds := make([]io.Reader, len(files))
+	sts := make([]os.FileInfo, len(files))
+	for i, fp := range files {
+		f, err := h.fs.Open(fp)
+		if err != nil {
+			code := 500
+			switch {
+			case isBundle: // a missing file is an error in the Bundle, which exists
+			case os.IsPermission(err):
+				code = 403
+			case os.IsNotExist(err):
+				code = 404
+			}
+			return cacheValue{}, code, fmt.Errorf("error opening %s: %v", names[i], err)
+		}
+		defer f.Close()
+		sts[i], err = f.Stat()
+		if err != nil {
+			return cacheValue{}, 500, fmt.Errorf("stat failed for %s: %v", names[i], err)
+		}
+		if sts[i].IsDir() {
+			code := 404
+			if isBundle {
+				code = 500
+			}
+			return cacheValue{}, code, fmt.Errorf("error opening %s: is a directory", names[i])
+		}
+		rds[i] = f
+	}
+
+	if h.cache == nil { // cache disabled
+		var cv cacheValue
+		var err error
+		cv.content, cv.hash, err = h.process(names, rds, checker)
+		if err != nil {
+			return cv, 500, fmt.Errorf("processing failed on %s: %w", name, err)
+		}
+		return cv, 200, nil
+	}
+
+	cv, ok := h.cache.get(p)
+
+	key := cacheValue{srcs: make([]srcStamp, len(files)), deps: h.depVersions(checker)}
+	for i, st := range sts {
+		key.srcs[i].size = st.Size()
+		if !st.ModTime().IsZero() {
+			key.srcs[i].tsnano = st.ModTime().UnixNano()
+		}
+	}
+
+	// The mod time can't be relied upon if there isn't one (e.g. embedded files) or the file may have been
+	// modified again within the file system's timestamp resolution after the output was cached.
+	// In these cases the content is hashed and compared.
+	racy := false
+	for i := range key.srcs {
+		if key.srcs[i].tsnano != 0 && !(ok && cv.racy) {
+			continue
+		}
+		b, err := ioutil.ReadAll(rds[i])
+		if err != nil {
+			return cacheValue{}, 500, fmt.Errorf("error reading %s: %v", names[i], err)
+		}
+		key.srcs[i].hash = xxhash.Sum64(b)
+		rds[i] = bytes.NewReader(b)
+		racy = racy || isRacy(sts[i].ModTime(), time.Now())
+	}
+	if ok && cv.racy && cv.matches(key) && !racy {
+		cv.racy = false
+		h.cache.put(p, cv)
+	}
+
+	if ok && cv.matches(key) {
+		h.cache.countHit()
+		return cv, 200, nil
+	}
+	h.cache.countMiss()
+
+	// concurrent misses for the same path share one conversion
+	cv, err := h.flight.do(ctx, p, func() (cacheValue, error) {
+		cv := key
+		cv.srcs = append([]srcStamp(nil), key.srcs...)
+		srcHashes := make([]hash.Hash64, len(rds))
+		trds := make([]io.Reader, len(rds))
+		for i := range rds {
+			srcHashes[i] = xxhash.New()
+			trds[i] = io.TeeReader(rds[i], srcHashes[i])
+		}
+		var err error
+		start := time.Now()
+		cv.content, cv.hash, err = h.process(names, trds, checker)
+		h.cache.setLastConversion(time.Since(start))
+		now := time.Now()
+		for i := range cv.srcs {
+			cv.srcs[i].hash = srcHashes[i].Sum64()
+			cv.racy = cv.racy || (cv.srcs[i].tsnano != 0 && isRacy(sts[i].ModTime(), now))
+		}
+		if err == nil && h.writeCloserFunc == nil {
+			cv.encoded, err = h.encodeAll(cv.content)
+		}
+		if err != nil {
+			return cv, fmt.Errorf("processing failed on %s: %w", name, err)
+		}
+		h.cache.put(p, cv)
+		return cv, nil
+	})
+	if err != nil {
+		return cv, 500, err
+	}
+	return cv, 200, nil
+}
+
+// inputs returns the input files for p, which is more than p itself if it is a Bundle, and the Bundle's PurgeChecker
+func (h *Handler) inputs(p string) (files []string, checker tailwind.PurgeChecker, isBundle bool) {
+	if b, ok := h.bundles[p]; ok {
+		return b.Files, b.PurgeChecker, true
+	}
+	return []string{p}, nil, false
+}
+
+// stamp returns a hash of the size and mod time of the input files for p and the dependency versions,
+// which changes when the output may have changed without needing to read the files.  If a file was
+// modified too recently for its mod time to be trusted (see isRacy), racy is true.
+func (h *Handler) stamp(p string) (stamp uint64, racy bool, err error) {
+	files, checker, _ := h.inputs(p)
+	d := xxhash.New()
+	var b [8]byte
+	put := func(v uint64) {
+		binary.LittleEndian.PutUint64(b[:], v)
+		d.Write(b[:])
+	}
+	for _, fp := range files {
+		f, err := h.fs.Open(fp)
+		if err != nil {
+			return 0, false, err
+		}
+		st, err := f.Stat()
+		f.Close()
+		if err != nil {
+			return 0, false, err
+		}
+		racy = racy || isRacy(st.ModTime(), time.Now())
+		put(uint64(st.Size()))
+		put(uint64(st.ModTime().UnixNano()))
+	}
+	for _, v := range h.depVersions(checker) {
+		put(v)
+	}
+	return d.Sum64(), racy, nil
+}
+
 func (h *Handler) makeW(w http.ResponseWriter, r *http.Request) io.WriteCloser {
 	var wc io.WriteCloser
 	if h.writeCloserFunc != nil {
@@ -223,22 +444,73 @@ func (h *Handler) makeW(w http.ResponseWriter, r *http.Request) io.WriteCloser {
 // 	return false
 // }
 
-func (h *Handler) process(w http.ResponseWriter, r *http.Request, rd io.Reader) (content string, hash uint64, reterr error) {
+// serve writes the output as the response, with a strong ETag derived from its hash so conditional
+// requests are answered the same way whether or not the output came from the cache.
+// No Last-Modified header is sent, since the input file's mod time does not reflect
+// changes to the dist or purge keys.  The encoded variants in cv are used if present,
+// otherwise (cache disabled) the output is sent uncompressed.
+func (h *Handler) serve(w http.ResponseWriter, r *http.Request, name string, cv cacheValue) {
+
+	if h.writeCloserFunc != nil {
 
-	wc := h.makeW(w, r)
-	defer wc.Close()
+		wc := h.makeW(w, r)
+		defer wc.Close()
+
+		// the ETag must differ for each encoding of the same content
+		w.Header().Set("ETag", etag(cv.hash, w.Header().Get("Content-Encoding")))
+
+		// handle 304s and HEAD properly with ServeContent
+		http.ServeContent(
+			&wwrap{Writer: wc, ResponseWriter: w},
+			r,
+			name,
+			time.Time{},
+			strings.NewReader(cv.content),
+		)
+		return
+	}
+
+	if len(cv.encoded) > 0 {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+
+	enc, content := h.negotiate(r, cv.content, cv.encoded)
+	w.Header().Set("ETag", etag(cv.hash, enc))
+	if enc != "" {
+		w = &encodingResponseWriter{ResponseWriter: w, encoding: enc}
+	}
+
+	// handle 304s, HEAD and ranges properly with ServeContent
+	http.ServeContent(w, r, name, time.Time{}, strings.NewReader(content))
+}
+
+// etag returns a strong entity tag for the output hash and content encoding
+func etag(hash uint64, encoding string) string {
+	if encoding != "" && encoding != "identity" {
+		return fmt.Sprintf(`"%016x-%s"`, hash, encoding)
+	}
+	return fmt.Sprintf(`"%016x"`, hash)
+}
+
+// process converts the input files together, purging with checker if it is not nil
+func (h *Handler) process(names []string, rds []io.Reader, checker tailwind.PurgeChecker) (content string, hash uint64, reterr error) {
 
 	var outbuf bytes.Buffer
 	// outbuf.Grow(4096)
 
 	d := xxhash.New()
 
-	// write to response (optionally via compressor from makeW), cache buffer, and hash calc'er at the same time
-	mw := io.MultiWriter(wc, &outbuf, d)
+	// write to cache buffer and hash calc'er at the same time
+	mw := io.MultiWriter(&outbuf, d)
 
 	conv := h.converterFunc(mw)
 	// conv := tailwind.New(mw, h.dist)
-	conv.AddReader(r.URL.Path, rd, false)
+	if checker != nil {
+		conv.SetPurgeChecker(purgeSnapshot(checker))
+	}
+	for i, rd := range rds {
+		conv.AddReader(names[i], rd, false)
+	}
 	err := conv.Run()
 	if err != nil {
 		reterr = err
@@ -263,10 +535,86 @@ func (n *nopWriteCloser) Close() error {
 // }
 
 type cacheValue struct {
-	size    int64  // in bytes
-	tsnano  int64  // file mod time
-	content string // output
-	hash    uint64 // for e-tag
+	srcs    []srcStamp        // each input file, more than one for a Bundle
+	racy    bool              // a file was modified too recently before caching to trust its tsnano, check its hash
+	deps    []uint64          // Version of each Dependency before processing
+	content string            // output
+	hash    uint64            // for e-tag
+	encoded map[string]string // output in each encoding, see SetEncoding
+}
+
+// srcStamp identifies the version of an input file
+type srcStamp struct {
+	size   int64  // in bytes
+	tsnano int64  // file mod time, 0 if not available
+	hash   uint64 // hash of the file content
+}
+
+// matches returns true if the output cached in cv can be used for input files with the sizes,
+// mod times, hashes (if mod time is not available or cv is racy) and dependency versions in key
+func (cv cacheValue) matches(key cacheValue) bool {
+	if len(cv.srcs) != len(key.srcs) {
+		return false
+	}
+	for i, src := range cv.srcs {
+		if src.size != key.srcs[i].size || src.tsnano != key.srcs[i].tsnano {
+			return false
+		}
+		if (src.tsnano == 0 || cv.racy) && src.hash != key.srcs[i].hash {
+			return false
+		}
+	}
+	if len(cv.deps) != len(key.deps) {
+		return false
+	}
+	for i := range cv.deps {
+		if cv.deps[i] != key.deps[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// memSize returns the approximate memory used by cv
+func (cv cacheValue) memSize() int64 {
+	n := int64(len(cv.content)) + int64(len(cv.srcs))*24 + int64(len(cv.deps))*8 + 64
+	for k, v := range cv.encoded {
+		n += int64(len(k) + len(v))
+	}
+	return n
+}
+
+// isRacy returns true if a file modified at modTime could be modified again at now without its mod time changing
+func isRacy(modTime, now time.Time) bool {
+	return now.Sub(modTime) < 2*time.Second
+}
+
+// purgeSnapshot returns a copy of the keys of a checker that changes over time and can provide them
+// (e.g. a twpurge.DirChecker), so one conversion sees a consistent set of keys, as NewDev does
+func purgeSnapshot(checker tailwind.PurgeChecker) tailwind.PurgeChecker {
+	if mc, ok := checker.(interface {
+		Dependency
+		Map() twpurge.Map
+	}); ok {
+		return mc.Map()
+	}
+	return checker
+}
+
+// depVersions returns the Version of each Dependency, followed by that of checker if it is one
+func (h *Handler) depVersions(checker tailwind.PurgeChecker) []uint64 {
+	d, _ := checker.(Dependency)
+	if len(h.deps) == 0 && d == nil {
+		return nil
+	}
+	ret := make([]uint64, 0, len(h.deps)+1)
+	for _, d := range h.deps {
+		ret = append(ret, d.Version())
+	}
+	if d != nil {
+		ret = append(ret, d.Version())
+	}
+	return ret
 }
 
 // wwrap wraps a ResponseWriter allowing us to override where the Write calls go
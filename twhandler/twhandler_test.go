@@ -1,15 +1,28 @@
 package twhandler_test
 
 import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"html/template"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 
+	"github.com/gotailwindcss/tailwind"
 	"github.com/gotailwindcss/tailwind/twembed"
 	"github.com/gotailwindcss/tailwind/twhandler"
+	"github.com/gotailwindcss/tailwind/twpurge"
 )
 
 func TestHandler(t *testing.T) {
@@ -41,3 +54,722 @@ func TestHandler(t *testing.T) {
 	// TODO: table test with cases for compressor, 304, mod time of file changes, multiple files, cache disabled, etc.
 
 }
+
+type testDep uint64
+
+func (d *testDep) Version() uint64 { return uint64(*d) }
+
+func TestHandlerCacheInvalidation(t *testing.T) {
+
+	td, err := ioutil.TempDir("", "TestHandlerCacheInvalidation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	fpath := filepath.Join(td, "a.css")
+	write := func(content string, mtime time.Time) {
+		if err := ioutil.WriteFile(fpath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fpath, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mfs := fstest.MapFS{"b.css": &fstest.MapFile{Data: []byte(`.b{@apply px-1;}`)}} // no mod time
+
+	n := 0
+	h := twhandler.NewFromFunc(http.Dir(td), "", func(w io.Writer) *tailwind.Converter {
+		n++
+		return tailwind.New(w, twembed.New())
+	})
+	hfs := twhandler.NewFromFunc(http.FS(mfs), "", func(w io.Writer) *tailwind.Converter {
+		n++
+		return tailwind.New(w, twembed.New())
+	})
+	var dep testDep
+	h.AddDependency(&dep)
+
+	get := func(h http.Handler, p string) string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", p, nil))
+		return w.Body.String()
+	}
+
+	check := func(desc string, h http.Handler, p string, wantN int, want string) {
+		t.Helper()
+		out := get(h, p)
+		if n != wantN {
+			t.Errorf("%s: expected %d conversions, got %d", desc, wantN, n)
+		}
+		if !strings.Contains(out, want) {
+			t.Errorf("%s: expected output containing %q, got %q", desc, want, out)
+		}
+	}
+
+	old := time.Now().Add(-time.Hour)
+	write(`.a{@apply px-1;}`, old)
+	check("first", h, "/a.css", 1, ".a{")
+	check("cached", h, "/a.css", 1, ".a{")
+
+	write(`.c{@apply px-1;}`, old.Add(time.Second))
+	check("mtime changed", h, "/a.css", 2, ".c{")
+	check("cached after mtime change", h, "/a.css", 2, ".c{")
+
+	write(`.a{@apply px-1;}`, old.Add(2*time.Second))
+	check("before racy", h, "/a.css", 3, ".a{")
+	dep++
+	check("dependency changed", h, "/a.css", 4, ".a{")
+	check("cached after dependency change", h, "/a.css", 4, ".a{")
+
+	now := time.Now()
+	write(`.d{@apply px-1;}`, now)
+	check("recent mtime", h, "/a.css", 5, ".d{")
+	write(`.e{@apply px-1;}`, now) // same size and mtime
+	check("same mtime and size, content changed", h, "/a.css", 6, ".e{")
+	check("cached after content change", h, "/a.css", 6, ".e{")
+
+	check("no mtime", hfs, "/b.css", 7, ".b{")
+	check("no mtime cached", hfs, "/b.css", 7, ".b{")
+	mfs["b.css"].Data = []byte(`.f{@apply px-1;}`)
+	check("no mtime content changed", hfs, "/b.css", 8, ".f{")
+
+}
+
+func TestHandlerETag(t *testing.T) {
+
+	td, _ := filepath.Abs("testdata")
+	h := twhandler.New(http.Dir(td), "/td1", twembed.New())
+	hnc := twhandler.New(http.Dir(td), "/td1", twembed.New())
+	hnc.SetCache(false)
+
+	do := func(h http.Handler, inm string) *http.Response {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/td1/demo1.css", nil)
+		if inm != "" {
+			r.Header.Set("If-None-Match", inm)
+		}
+		h.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	res := do(h, "")
+	etag := res.Header.Get("ETag")
+	if res.StatusCode != 200 || !strings.HasPrefix(etag, `"`) || strings.HasPrefix(etag, "W/") {
+		t.Fatalf("expected 200 with strong ETag, got %d %q", res.StatusCode, etag)
+	}
+	if lm := res.Header.Get("Last-Modified"); lm != "" {
+		t.Errorf("unexpected Last-Modified %q", lm)
+	}
+
+	for _, hh := range []http.Handler{h, hnc} { // cached and uncached behave the same
+		if res := do(hh, ""); res.Header.Get("ETag") != etag {
+			t.Errorf("ETag mismatch: %q != %q", res.Header.Get("ETag"), etag)
+		}
+		if res := do(hh, etag); res.StatusCode != 304 {
+			t.Errorf("expected 304 for matching If-None-Match, got %d", res.StatusCode)
+		}
+		if res := do(hh, `"other", `+etag); res.StatusCode != 304 {
+			t.Errorf("expected 304 for matching If-None-Match list, got %d", res.StatusCode)
+		}
+		if res := do(hh, `"other"`); res.StatusCode != 200 {
+			t.Errorf("expected 200 for non-matching If-None-Match, got %d", res.StatusCode)
+		}
+	}
+
+	hgz := twhandler.New(http.Dir(td), "/td1", twembed.New())
+	hgz.SetWriteCloserFunc(func(w http.ResponseWriter, r *http.Request) io.WriteCloser {
+		w.Header().Set("Content-Encoding", "gzip")
+		return gzip.NewWriter(w)
+	})
+	if res := do(hgz, ""); res.Header.Get("ETag") != strings.TrimSuffix(etag, `"`)+`-gzip"` {
+		t.Errorf("expected ETag for gzip encoding, got %q", res.Header.Get("ETag"))
+	}
+
+}
+
+func TestHandlerEncoding(t *testing.T) {
+
+	td, _ := filepath.Abs("testdata")
+
+	nrev := 0
+	rev := func(w io.Writer) io.WriteCloser { // a fake encoding which makes the output smaller than gzip
+		nrev++
+		return &truncWriter{w: w}
+	}
+
+	h := twhandler.New(http.Dir(td), "/td1", twembed.New())
+	h.SetEncoding("x-trunc", rev)
+	hnc := twhandler.New(http.Dir(td), "/td1", twembed.New())
+	hnc.SetCache(false)
+
+	do := func(h http.Handler, ae, rng string) *http.Response {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/td1/demo1.css", nil)
+		if ae != "" {
+			r.Header.Set("Accept-Encoding", ae)
+		}
+		if rng != "" {
+			r.Header.Set("Range", rng)
+		}
+		h.ServeHTTP(w, r)
+		return w.Result()
+	}
+	body := func(res *http.Response) string {
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	identity := body(do(h, "", ""))
+
+	res := do(h, "br, gzip;q=0.9", "")
+	if res.Header.Get("Content-Encoding") != "gzip" || res.Header.Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("expected gzip with Vary, got %v", res.Header)
+	}
+	b := body(res)
+	if cl := res.Header.Get("Content-Length"); cl != strconv.Itoa(len(b)) {
+		t.Errorf("Content-Length %q does not match body length %d", cl, len(b))
+	}
+	gr, err := gzip.NewReader(strings.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ub, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ub) != identity {
+		t.Errorf("gzip content does not match identity")
+	}
+
+	res = do(h, "gzip", "bytes=0-9")
+	if res.StatusCode != 206 || res.Header.Get("Content-Encoding") != "gzip" || body(res) != b[:10] {
+		t.Errorf("range of gzip content failed: %d %v", res.StatusCode, res.Header)
+	}
+
+	res = do(h, "gzip;q=0, identity", "")
+	if res.Header.Get("Content-Encoding") != "" || body(res) != identity {
+		t.Errorf("expected identity when gzip refused, got %v", res.Header)
+	}
+
+	// without the cache output is not encoded on every request
+	res = do(hnc, "gzip", "")
+	if res.Header.Get("Content-Encoding") != "" || res.Header.Get("Vary") != "" || body(res) != identity {
+		t.Errorf("expected identity without cache, got %v", res.Header)
+	}
+
+	// equal quality prefers the smallest, and each encoding is produced once
+	for i := 0; i < 3; i++ {
+		res := do(h, "gzip, x-trunc", "")
+		if res.Header.Get("Content-Encoding") != "x-trunc" || body(res) != identity[:10] {
+			t.Errorf("expected x-trunc encoding, got %v", res.Header)
+		}
+		if !strings.HasSuffix(res.Header.Get("ETag"), `-x-trunc"`) {
+			t.Errorf("expected ETag for x-trunc, got %q", res.Header.Get("ETag"))
+		}
+	}
+	if nrev != 1 {
+		t.Errorf("expected x-trunc encoding to run once, got %d", nrev)
+	}
+
+}
+
+// truncWriter keeps only the first 10 bytes written
+type truncWriter struct {
+	w io.Writer
+	n int
+}
+
+func (tw *truncWriter) Write(p []byte) (int, error) {
+	if tw.n < 10 {
+		b := p
+		if len(b) > 10-tw.n {
+			b = b[:10-tw.n]
+		}
+		tw.n += len(b)
+		if _, err := tw.w.Write(b); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (tw *truncWriter) Close() error { return nil }
+
+func TestHandlerCoalesce(t *testing.T) {
+
+	td, _ := filepath.Abs("testdata")
+
+	var mu sync.Mutex
+	n := 0
+	started := make(chan struct{})
+	release := make(chan struct{})
+	h := twhandler.NewFromFunc(http.Dir(td), "/td1", func(w io.Writer) *tailwind.Converter {
+		mu.Lock()
+		n++
+		mu.Unlock()
+		close(started)
+		<-release
+		return tailwind.New(w, twembed.New())
+	})
+
+	get := func(ctx context.Context) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/td1/demo1.css", nil).WithContext(ctx))
+		return w
+	}
+
+	const count = 5
+	results := make(chan *httptest.ResponseRecorder, count)
+	go func() { results <- get(context.Background()) }()
+	<-started
+	for i := 1; i < count; i++ {
+		go func() { results <- get(context.Background()) }()
+	}
+
+	// a waiter whose request is cancelled returns without waiting for the conversion
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan struct{})
+	go func() {
+		get(ctx)
+		close(cancelled)
+	}()
+	time.Sleep(50 * time.Millisecond) // let the requests reach the wait
+	cancel()
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("cancelled request did not return")
+	}
+
+	close(release)
+	var body string
+	for i := 0; i < count; i++ {
+		w := <-results
+		if w.Code != 200 || !strings.Contains(w.Body.String(), ".test1{") {
+			t.Errorf("unexpected response %d %q", w.Code, w.Body.String())
+		}
+		if i > 0 && w.Body.String() != body {
+			t.Errorf("response bodies differ")
+		}
+		body = w.Body.String()
+	}
+	if n != 1 {
+		t.Errorf("expected 1 conversion, got %d", n)
+	}
+
+}
+
+func TestHandlerCacheLimits(t *testing.T) {
+
+	td, err := ioutil.TempDir("", "TestHandlerCacheLimits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	for _, name := range []string{"a.css", "b.css"} {
+		if err := ioutil.WriteFile(filepath.Join(td, name), []byte(`.x{@apply px-1;}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(filepath.Join(td, name), time.Now().Add(-time.Hour), time.Now().Add(-time.Hour))
+	}
+
+	h := twhandler.New(http.Dir(td), "/css", twembed.New())
+	get := func(p string) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", p, nil))
+		if w.Code != 200 {
+			t.Fatalf("%s: unexpected status %d", p, w.Code)
+		}
+	}
+	expect := func(desc string, entries int, hits, misses, evictions uint64) {
+		t.Helper()
+		st := h.CacheStats()
+		if st.Entries != entries || st.Hits != hits || st.Misses != misses || st.Evictions != evictions {
+			t.Errorf("%s: unexpected stats %+v", desc, st)
+		}
+		if (entries == 0) != (st.Bytes == 0) {
+			t.Errorf("%s: unexpected bytes %d for %d entries", desc, st.Bytes, entries)
+		}
+	}
+
+	get("/css/a.css")
+	get("/css/a.css")
+	get("/css/b.css")
+	expect("unlimited", 2, 1, 2, 0)
+	if h.CacheStats().LastConversion <= 0 {
+		t.Errorf("expected LastConversion to be set")
+	}
+
+	h.SetCacheLimits(1, 0)
+	expect("limit entries", 1, 1, 2, 1)
+	get("/css/b.css") // most recently used is kept
+	expect("kept b", 1, 2, 2, 1)
+	get("/css/a.css")
+	expect("evicted b", 1, 2, 3, 2)
+
+	h.Invalidate("/css/a.css")
+	expect("invalidate", 0, 2, 3, 2)
+	get("/css/a.css")
+	expect("after invalidate", 1, 2, 4, 2)
+
+	h.Purge()
+	expect("purge", 0, 2, 4, 2)
+
+	h.SetCacheLimits(0, 10) // too small for any output
+	get("/css/a.css")
+	get("/css/a.css")
+	expect("too large", 0, 2, 6, 2)
+
+}
+
+func TestHandlerLiveReload(t *testing.T) {
+
+	td, err := ioutil.TempDir("", "TestHandlerLiveReload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	fpath := filepath.Join(td, "a.css")
+	write := func(content string, mtime time.Time) {
+		if err := ioutil.WriteFile(fpath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fpath, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`.a{@apply px-1;}`, time.Now().Add(-time.Hour))
+
+	h := twhandler.New(http.Dir(td), "/css", twembed.New())
+	h.SetLiveReload(10 * time.Millisecond)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/css" + twhandler.LiveReloadScriptPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != 200 || !strings.Contains(string(b), `"/css/_livereload"`) {
+		t.Errorf("unexpected script response %d %s", res.StatusCode, b)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequest("GET", srv.URL+"/css"+twhandler.LiveReloadPath+"?path=/css/a.css", nil)
+	res, err = http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected Content-Type %q", ct)
+	}
+
+	lines := make(chan string)
+	go func() {
+		s := bufio.NewScanner(res.Body)
+		for s.Scan() {
+			lines <- s.Text()
+		}
+		close(lines)
+	}()
+
+	write(`.b{@apply px-1;}`, time.Now().Add(-time.Minute))
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatalf("event stream closed")
+			}
+			if strings.HasPrefix(line, "data: ") {
+				if !strings.Contains(line, `"path":"/css/a.css"`) {
+					t.Errorf("unexpected event data %q", line)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no change event")
+		}
+	}
+
+}
+
+func TestHandlerErrorOverlay(t *testing.T) {
+
+	mfs := fstest.MapFS{
+		"bad.css":  &fstest.MapFile{Data: []byte(".a{color:red;}\n.b{@apply nope;}\n")},
+		"good.css": &fstest.MapFile{Data: []byte(`.a{@apply px-1;}`)},
+	}
+	h := twhandler.New(http.FS(mfs), "/css", twembed.New())
+
+	var logged []error
+	h.SetErrorFunc(func(r *http.Request, err error) {
+		logged = append(logged, err)
+	})
+
+	get := func(p string) *httptest.ResponseRecorder {
+		wr := httptest.NewRecorder()
+		h.ServeHTTP(wr, httptest.NewRequest("GET", p, nil))
+		return wr
+	}
+
+	wr := get("/css/bad.css")
+	if wr.Code != 500 || len(logged) != 1 {
+		t.Errorf("expected 500 and a logged error without overlay, got %d and %d errors", wr.Code, len(logged))
+	}
+
+	h.SetErrorOverlay(true)
+	wr = get("/css/bad.css")
+	if wr.Code != 200 {
+		t.Errorf("expected 200 for overlay, got %d", wr.Code)
+	}
+	if ct := wr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/css") {
+		t.Errorf("unexpected Content-Type %q", ct)
+	}
+	if cc := wr.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("unexpected Cache-Control %q", cc)
+	}
+	body := wr.Body.String()
+	if !strings.Contains(body, "body::before") || !strings.Contains(body, "/css/bad.css") || !strings.Contains(body, "nope") {
+		t.Errorf("unexpected overlay body: %s", body)
+	}
+	if len(logged) != 2 {
+		t.Errorf("expected 2 logged errors, got %d", len(logged))
+	}
+
+	// other errors keep their status
+	for _, p := range []string{"/css/missing.css", "/css/", "/css"} {
+		if wr := get(p); wr.Code != 404 {
+			t.Errorf("%s: expected 404 with overlay, got %d", p, wr.Code)
+		}
+	}
+
+	// successful output is unaffected
+	wr = get("/css/good.css")
+	if wr.Code != 200 || strings.Contains(wr.Body.String(), "body::before") {
+		t.Errorf("unexpected response for good file %d: %s", wr.Code, wr.Body.String())
+	}
+
+	// errors with a position include it
+	mfs["bad.css"] = &fstest.MapFile{Data: []byte(".a{}\n.b{;;:}\n")}
+	body = get("/css/bad.css").Body.String()
+	if !strings.Contains(body, "/css/bad.css:2:6: ") {
+		t.Errorf("expected position in overlay body: %s", body)
+	}
+}
+
+func TestNewDev(t *testing.T) {
+
+	css := fstest.MapFS{"main.css": &fstest.MapFile{Data: []byte("@tailwind utilities;\n")}}
+	markup := fstest.MapFS{
+		"index.html": &fstest.MapFile{Data: []byte(`<div class="px-1"></div>`), ModTime: time.Now().Add(-time.Hour)},
+	}
+	h, err := twhandler.NewDev(http.FS(css), "/css", twembed.New(), http.FS(markup))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func() string {
+		wr := httptest.NewRecorder()
+		h.ServeHTTP(wr, httptest.NewRequest("GET", "/css/main.css", nil))
+		if wr.Code != 200 {
+			t.Fatalf("unexpected status %d: %s", wr.Code, wr.Body.String())
+		}
+		return wr.Body.String()
+	}
+
+	out := get()
+	if !strings.Contains(out, ".px-1") || strings.Contains(out, ".py-2") {
+		t.Errorf("expected px-1 and not py-2 in output: %s", out)
+	}
+
+	markup["index.html"] = &fstest.MapFile{Data: []byte(`<div class="px-1 py-2"></div>`), ModTime: time.Now().Add(-time.Minute)}
+	time.Sleep(twhandler.DevRescanInterval + 10*time.Millisecond)
+	out = get()
+	if !strings.Contains(out, ".py-2") {
+		t.Errorf("expected py-2 in output after markup changed: %s", out)
+	}
+
+	wr := httptest.NewRecorder()
+	h.ServeHTTP(wr, httptest.NewRequest("GET", "/css/missing.css", nil))
+	if wr.Code != 404 {
+		t.Errorf("expected 404 for missing file, got %d", wr.Code)
+	}
+}
+
+func TestHandlerFingerprint(t *testing.T) {
+
+	mfs := fstest.MapFS{"main.css": &fstest.MapFile{Data: []byte(`.a{@apply px-1;}`)}}
+	h := twhandler.New(http.FS(mfs), "/css", twembed.New())
+	h.SetMaxAge(60)
+
+	get := func(p string) *httptest.ResponseRecorder {
+		wr := httptest.NewRecorder()
+		h.ServeHTTP(wr, httptest.NewRequest("GET", p, nil))
+		return wr
+	}
+
+	var buf strings.Builder
+	tmpl := template.Must(template.New("").Funcs(h.FuncMap()).Parse(`<link rel="stylesheet" href="{{ twcss "main.css" }}">`))
+	if err := tmpl.Execute(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	u1, err := h.URL("main.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != `<link rel="stylesheet" href="`+u1+`">` {
+		t.Errorf("unexpected template output %q", buf.String())
+	}
+	if ok, _ := path.Match("/css/main.????????????????.css", u1); !ok {
+		t.Fatalf("unexpected URL %q", u1)
+	}
+
+	wr := get(u1)
+	if wr.Code != 200 || wr.Body.String() != get("/css/main.css").Body.String() {
+		t.Errorf("unexpected response for fingerprinted URL %d: %s", wr.Code, wr.Body.String())
+	}
+	if cc := wr.Header().Get("Cache-Control"); cc != "public, max-age=31536000, immutable" {
+		t.Errorf("unexpected Cache-Control for fingerprinted URL %q", cc)
+	}
+	if cc := get("/css/main.css").Header().Get("Cache-Control"); cc != "public, max-age=60" {
+		t.Errorf("unexpected Cache-Control for plain URL %q", cc)
+	}
+	wr = httptest.NewRecorder()
+	wr.Header().Set("Cache-Control", "private")
+	h.ServeHTTP(wr, httptest.NewRequest("GET", u1, nil))
+	if cc := wr.Header().Get("Cache-Control"); cc != "private" {
+		t.Errorf("Cache-Control already set for fingerprinted URL was replaced with %q", cc)
+	}
+
+	mfs["main.css"] = &fstest.MapFile{Data: []byte(`.b{@apply px-1;}`)}
+	u2, err := h.URL("main.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u2 == u1 {
+		t.Fatalf("URL did not change with output")
+	}
+	wr = get(u1)
+	if wr.Code != http.StatusFound || wr.Header().Get("Location") != u2 {
+		t.Errorf("expected redirect from stale URL to %s, got %d %s", u2, wr.Code, wr.Header().Get("Location"))
+	}
+
+	if wr := get("/css/nope.0123456789abcdef.css"); wr.Code != 404 {
+		t.Errorf("expected 404 for fingerprinted missing file, got %d", wr.Code)
+	}
+	if _, err := h.URL("nope.css"); err == nil {
+		t.Errorf("expected error for URL of missing file")
+	}
+}
+
+// snapshotChecker purges everything itself, so output keeping its keys shows Map was used instead
+type snapshotChecker struct {
+	testDep
+	keys twpurge.Map
+	maps int
+}
+
+func (c *snapshotChecker) ShouldPurgeKey(k string) bool { return true }
+
+func (c *snapshotChecker) Map() twpurge.Map {
+	c.maps++
+	return c.keys
+}
+
+func TestHandlerBundle(t *testing.T) {
+
+	mfs := fstest.MapFS{
+		"vendor.css": &fstest.MapFile{Data: []byte(`.v{color:red;}`)},
+		"app.css":    &fstest.MapFile{Data: []byte(`.a{@apply px-1;}`)},
+		"utils.css":  &fstest.MapFile{Data: []byte(`@tailwind utilities;`)},
+	}
+	h := twhandler.New(http.FS(mfs), "/css", twembed.New())
+	h.AddBundle(twhandler.Bundle{Name: "all.css", Files: []string{"vendor.css", "/app.css"}})
+	h.AddBundle(twhandler.Bundle{Name: "utils.css", Files: []string{"utils.css"}, PurgeChecker: twpurge.Map{"py-2": {}}})
+	h.AddBundle(twhandler.Bundle{Name: "broken.css", Files: []string{"vendor.css", "nope.css"}})
+	sc := &snapshotChecker{keys: twpurge.Map{"px-1": {}}}
+	h.AddBundle(twhandler.Bundle{Name: "snap.css", Files: []string{"utils.css"}, PurgeChecker: sc})
+
+	get := func(p string) *httptest.ResponseRecorder {
+		wr := httptest.NewRecorder()
+		h.ServeHTTP(wr, httptest.NewRequest("GET", p, nil))
+		return wr
+	}
+
+	wr := get("/css/all.css")
+	out := wr.Body.String()
+	if wr.Code != 200 || !strings.Contains(out, ".v{color:red") || !strings.Contains(out, ".a{padding") {
+		t.Fatalf("unexpected bundle response %d: %s", wr.Code, out)
+	}
+	if strings.Index(out, ".v") > strings.Index(out, ".a") {
+		t.Errorf("bundle files out of order: %s", out)
+	}
+	if h.CacheStats().Misses != 1 {
+		t.Errorf("expected 1 miss, got %+v", h.CacheStats())
+	}
+
+	mfs["app.css"] = &fstest.MapFile{Data: []byte(`.b{@apply px-1;}`)}
+	out = get("/css/all.css").Body.String()
+	if !strings.Contains(out, ".b{padding") || !strings.Contains(out, ".v{color:red") {
+		t.Errorf("bundle not regenerated after a file changed: %s", out)
+	}
+
+	out = get("/css/utils.css").Body.String()
+	if !strings.Contains(out, ".py-2") || strings.Contains(out, ".px-1") {
+		t.Errorf("bundle not purged with its checker: %s", out)
+	}
+
+	out = get("/css/snap.css").Body.String()
+	if !strings.Contains(out, ".px-1") || strings.Contains(out, ".py-2") || sc.maps != 1 {
+		t.Errorf("bundle not purged with a snapshot of its checker (%d snapshots): %s", sc.maps, out)
+	}
+
+	if wr := get("/css/broken.css"); wr.Code != 500 || !strings.Contains(wr.Body.String(), "nope.css") {
+		t.Errorf("expected 500 for bundle with missing file, got %d: %s", wr.Code, wr.Body.String())
+	}
+}
+
+func TestHandlerLiveReloadNoCache(t *testing.T) {
+
+	mfs := fstest.MapFS{"a.css": &fstest.MapFile{Data: []byte(`.a{@apply px-1;}`), ModTime: time.Now().Add(-time.Hour)}}
+	var mu sync.Mutex
+	nconv := 0
+	h := twhandler.NewFromFunc(http.FS(mfs), "/css", func(w io.Writer) *tailwind.Converter {
+		mu.Lock()
+		nconv++
+		mu.Unlock()
+		return tailwind.New(w, twembed.New())
+	})
+	h.SetCache(false)
+	h.SetLiveReload(5 * time.Millisecond)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequest("GET", srv.URL+"/css"+twhandler.LiveReloadPath+"?path=/css/a.css", nil)
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body) // until the timeout
+	res.Body.Close()
+
+	// the files are unchanged, so the output is only produced for the initial version
+	mu.Lock()
+	defer mu.Unlock()
+	if nconv != 1 {
+		t.Errorf("expected 1 conversion without changes, got %d", nconv)
+	}
+}
@@ -0,0 +1,132 @@
+package twpurge
+
+import "sync"
+
+// CheckerFunc adapts an ordinary function to a Checker.
+type CheckerFunc func(k string) bool
+
+// ShouldPurgeKey implements Checker by calling f(k).
+func (f CheckerFunc) ShouldPurgeKey(k string) bool {
+	return f(k)
+}
+
+// Union returns a Checker which keeps the union of the keys kept by each of the checkers,
+// i.e. a key is only purged if every one of them says to purge it.
+// This is how to combine e.g. the purge maps of several services.
+// With no checkers, every key is purged.
+func Union(checkers ...Checker) Checker {
+	return CheckerFunc(func(k string) bool {
+		for _, c := range checkers {
+			if !c.ShouldPurgeKey(k) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// Intersection returns a Checker which keeps the intersection of the keys kept by each
+// of the checkers, i.e. a key is purged if any one of them says to purge it.
+// With no checkers, no key is purged.
+func Intersection(checkers ...Checker) Checker {
+	return CheckerFunc(func(k string) bool {
+		for _, c := range checkers {
+			if c.ShouldPurgeKey(k) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Not returns a Checker which keeps exactly the keys c purges, and vice versa.
+// For example Intersection(m, Not(blocked)) keeps the keys in m which are not in blocked.
+func Not(c Checker) Checker {
+	return CheckerFunc(func(k string) bool {
+		return !c.ShouldPurgeKey(k)
+	})
+}
+
+// Set is a set of purge keys which implements Checker and is safe for concurrent use,
+// so it can be changed at runtime while conversions are using it.
+// The zero value is an empty Set ready to use.
+type Set struct {
+	rwmu sync.RWMutex
+	m    Map
+}
+
+// NewSet returns a Set containing the keys provided.
+func NewSet(keys ...string) *Set {
+	s := &Set{}
+	s.Add(keys...)
+	return s
+}
+
+// ShouldPurgeKey implements Checker.
+func (s *Set) ShouldPurgeKey(k string) bool {
+	return !s.Has(k)
+}
+
+// Has returns true if k is in the Set.
+func (s *Set) Has(k string) bool {
+	s.rwmu.RLock()
+	_, ok := s.m[k]
+	s.rwmu.RUnlock()
+	return ok
+}
+
+// Add adds keys to the Set.
+func (s *Set) Add(keys ...string) {
+	s.rwmu.Lock()
+	defer s.rwmu.Unlock()
+	if s.m == nil {
+		s.m = make(Map, len(keys))
+	}
+	for _, k := range keys {
+		s.m[k] = struct{}{}
+	}
+}
+
+// Remove removes keys from the Set.
+func (s *Set) Remove(keys ...string) {
+	s.rwmu.Lock()
+	defer s.rwmu.Unlock()
+	for _, k := range keys {
+		delete(s.m, k)
+	}
+}
+
+// Merge adds all of the keys in m to the Set.
+func (s *Set) Merge(m Map) {
+	s.rwmu.Lock()
+	defer s.rwmu.Unlock()
+	if s.m == nil {
+		s.m = make(Map, len(m))
+	}
+	s.m.Merge(m)
+}
+
+// Replace replaces the contents of the Set with a copy of m.
+func (s *Set) Replace(m Map) {
+	newm := make(Map, len(m))
+	newm.Merge(m)
+	s.rwmu.Lock()
+	s.m = newm
+	s.rwmu.Unlock()
+}
+
+// Len returns the number of keys in the Set.
+func (s *Set) Len() int {
+	s.rwmu.RLock()
+	defer s.rwmu.RUnlock()
+	return len(s.m)
+}
+
+// Map returns a copy of the contents of the Set.
+func (s *Set) Map() Map {
+	s.rwmu.RLock()
+	defer s.rwmu.RUnlock()
+	ret := make(Map, len(s.m))
+	ret.Merge(s.m)
+	return ret
+}
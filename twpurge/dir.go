@@ -0,0 +1,239 @@
+package twpurge
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChangeSource reports which files have changed, so DirChecker knows what to rescan.
+type ChangeSource interface {
+	// Changes returns the paths of files which were added, modified or removed
+	// since the previous call.  The first call should return every file.
+	Changes() ([]string, error)
+}
+
+// DirChecker is a Checker which keeps the keys found by scanning the files in one or more
+// directories, and rescans the files which have changed when asked to (see Refresh)
+// or on demand after an interval.  By default changes are found by polling file
+// modification times and sizes, see SetChangeSource to use something else.
+// It is safe for concurrent use.
+//
+// This is intended for development, where markup changes while the program runs.
+// Consumers which cache output can use Version to see if the keys have changed.
+type DirChecker struct {
+	rwmu      sync.RWMutex
+	scanner   *Scanner
+	roots     []dirRoot
+	source    ChangeSource // nil means poll
+	poll      *pollSource
+	interval  time.Duration
+	loaded    bool
+	lastCheck time.Time
+	version   uint64
+	err       error
+}
+
+type dirRoot struct {
+	wfs     walkFS
+	dir     string
+	fnmatch func(fn string) bool
+}
+
+// NewDirChecker returns a DirChecker which scans with scanner.  The files are scanned the
+// first time the checker is used, and then again (only those that changed) upon demand
+// if more than interval has passed since the last check.  An interval of zero or less
+// means files are only rescanned when Refresh is called.  Use AddRoot or AddRootHTTPFileSystem to specify the directories.
+func NewDirChecker(scanner *Scanner, interval time.Duration) *DirChecker {
+	return &DirChecker{
+		scanner:  scanner,
+		interval: interval,
+	}
+}
+
+// AddRoot adds a directory to be scanned recursively.  The fnmatch func says which files to scan,
+// if nil is passed then MatchDefault will be used.  AddRoot should be called before the checker is used.
+func (c *DirChecker) AddRoot(dir string, fnmatch func(fn string) bool) {
+	c.addRoot(osWalkFS{}, dir, fnmatch)
+}
+
+// AddRootHTTPFileSystem is like AddRoot but scans dir in hfs, e.g. "/" for all of it.
+// Files are recorded with their hfs path as the name, so paths in different
+// file systems should not overlap.
+func (c *DirChecker) AddRootHTTPFileSystem(hfs http.FileSystem, dir string, fnmatch func(fn string) bool) {
+	c.addRoot(httpWalkFS{hfs: hfs}, dir, fnmatch)
+}
+
+func (c *DirChecker) addRoot(wfs walkFS, dir string, fnmatch func(fn string) bool) {
+	if fnmatch == nil {
+		fnmatch = MatchDefault
+	}
+	c.rwmu.Lock()
+	defer c.rwmu.Unlock()
+	c.roots = append(c.roots, dirRoot{wfs: wfs, dir: dir, fnmatch: fnmatch})
+	c.poll = nil
+}
+
+// SetChangeSource replaces polling with another way of detecting changes,
+// e.g. a file system watcher or, in tests, a list of paths.  Paths returned which
+// are not in one of the roots or which do not match its fnmatch func are ignored.
+func (c *DirChecker) SetChangeSource(source ChangeSource) {
+	c.rwmu.Lock()
+	defer c.rwmu.Unlock()
+	c.source = source
+}
+
+// ShouldPurgeKey implements Checker.  Since the files may be rescanned between calls, use Map
+// to check a consistent set of keys, e.g. for the whole of a conversion.
+func (c *DirChecker) ShouldPurgeKey(k string) bool {
+	c.maybeRefresh()
+	c.rwmu.RLock()
+	defer c.rwmu.RUnlock()
+	return c.scanner.Map().ShouldPurgeKey(k)
+}
+
+// Version returns a number which is incremented each time the set of keys changes.
+// Like ShouldPurgeKey, it checks for changes first if the interval has passed.
+func (c *DirChecker) Version() uint64 {
+	c.maybeRefresh()
+	c.rwmu.RLock()
+	defer c.rwmu.RUnlock()
+	return c.version
+}
+
+// Err returns the error, if any, from the last check for changes.
+func (c *DirChecker) Err() error {
+	c.rwmu.RLock()
+	defer c.rwmu.RUnlock()
+	return c.err
+}
+
+// Map returns a copy of the keys currently kept.
+func (c *DirChecker) Map() Map {
+	c.maybeRefresh()
+	c.rwmu.RLock()
+	defer c.rwmu.RUnlock()
+	ret := make(Map, len(c.scanner.Map()))
+	ret.Merge(c.scanner.Map())
+	return ret
+}
+
+// maybeRefresh calls Refresh if this is the first use or the interval has passed
+func (c *DirChecker) maybeRefresh() {
+	c.rwmu.RLock()
+	due := !c.loaded || (c.interval > 0 && time.Since(c.lastCheck) >= c.interval)
+	c.rwmu.RUnlock()
+	if due {
+		c.Refresh()
+	}
+}
+
+// Refresh checks for changes now and rescans the files that changed.
+// The error is also available from Err until the next check.
+func (c *DirChecker) Refresh() error {
+
+	c.rwmu.Lock()
+	defer c.rwmu.Unlock()
+
+	c.loaded = true
+	c.lastCheck = time.Now()
+
+	source := c.source
+	if source == nil {
+		if c.poll == nil {
+			c.poll = &pollSource{scanner: c.scanner, roots: c.roots}
+		}
+		source = c.poll
+	}
+
+	changes, err := source.Changes()
+	if err != nil {
+		c.err = err
+		return err
+	}
+
+	mods := c.scanner.mods
+	c.err = nil
+	for _, fpath := range changes {
+		root := c.matchRoot(fpath)
+		if root == nil {
+			continue
+		}
+		if err := c.scanner.rescanFile(root.wfs, fpath); err != nil && c.err == nil {
+			c.err = err
+		}
+	}
+	if c.scanner.mods != mods {
+		c.version++
+	}
+
+	return c.err
+}
+
+// matchRoot returns the first root which fpath is in and matches, or nil
+func (c *DirChecker) matchRoot(fpath string) *dirRoot {
+	for i := range c.roots {
+		root := &c.roots[i]
+		if root.contains(fpath) && root.fnmatch(fpath) {
+			return root
+		}
+	}
+	return nil
+}
+
+func (r *dirRoot) contains(fpath string) bool {
+	if _, ok := r.wfs.(osWalkFS); !ok {
+		dir := path.Clean(r.dir)
+		fpath = path.Clean(fpath)
+		return dir == "." || (dir == "/" && strings.HasPrefix(fpath, "/")) ||
+			fpath == dir || strings.HasPrefix(fpath, dir+"/")
+	}
+	rel, err := filepath.Rel(r.dir, fpath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// pollSource implements ChangeSource by walking the roots and comparing modification times and sizes,
+// the scanner's WalkOptions say which files are walked
+type pollSource struct {
+	scanner *Scanner
+	roots   []dirRoot
+	stamps  map[string]fileStamp
+}
+
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+func (ps *pollSource) Changes() ([]string, error) {
+
+	stamps := make(map[string]fileStamp, len(ps.stamps))
+	var changes []string
+
+	for _, root := range ps.roots {
+		err := ps.scanner.walk(root.wfs, root.dir, root.fnmatch, func(fpath string, info os.FileInfo) error {
+			st := fileStamp{size: info.Size(), modTime: info.ModTime()}
+			stamps[fpath] = st
+			if prev, ok := ps.stamps[fpath]; !ok || prev.size != st.size || !prev.modTime.Equal(st.modTime) {
+				changes = append(changes, fpath)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for fpath := range ps.stamps {
+		if _, ok := stamps[fpath]; !ok { // removed
+			changes = append(changes, fpath)
+		}
+	}
+
+	ps.stamps = stamps
+	return changes, nil
+}
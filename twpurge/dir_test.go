@@ -0,0 +1,334 @@
+package twpurge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+type sliceChangeSource [][]string
+
+func (s *sliceChangeSource) Changes() ([]string, error) {
+	if len(*s) == 0 {
+		return nil, nil
+	}
+	ret := (*s)[0]
+	*s = (*s)[1:]
+	return ret, nil
+}
+
+func TestDirChecker(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "TestDirChecker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		t.Helper()
+		fpath := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fpath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return fpath
+	}
+	a := write("a.html", `<b class="px-1">`)
+	b := write("b.html", `<b class="py-2">`)
+	txt := write("c.txt", `<b class="p-1">`)
+
+	src := &sliceChangeSource{
+		{a, b, txt},
+		{a},
+		{b},
+		nil,
+	}
+
+	c := NewDirChecker(NewScanner(map[string]struct{}{"px-1": {}, "py-2": {}, "p-1": {}, "m-1": {}}), time.Hour)
+	c.AddRoot(dir, nil)
+	c.SetChangeSource(src)
+
+	if c.ShouldPurgeKey("px-1") || c.ShouldPurgeKey("py-2") || !c.ShouldPurgeKey("p-1") {
+		t.Fatalf("unexpected initial keys: %v", c.Map())
+	}
+	v := c.Version()
+
+	write("a.html", `<b class="m-1">`)
+	if err := c.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if !c.ShouldPurgeKey("px-1") || c.ShouldPurgeKey("m-1") {
+		t.Errorf("change not picked up: %v", c.Map())
+	}
+	if c.Version() == v {
+		t.Errorf("version should have changed")
+	}
+	v = c.Version()
+
+	os.Remove(b)
+	if err := c.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if !c.ShouldPurgeKey("py-2") {
+		t.Errorf("removed file still has keys: %v", c.Map())
+	}
+	v = c.Version()
+
+	if err := c.Refresh(); err != nil { // no changes
+		t.Fatal(err)
+	}
+	if c.Version() != v {
+		t.Errorf("version should not have changed")
+	}
+
+}
+
+func TestDirCheckerPoll(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "TestDirCheckerPoll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fpath := filepath.Join(dir, "a.html")
+	if err := ioutil.WriteFile(fpath, []byte(`<b class="px-1">`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewDirChecker(NewScanner(nil), 0)
+	c.AddRoot(dir, nil)
+	if c.ShouldPurgeKey("px-1") {
+		t.Fatalf("missing px-1")
+	}
+
+	if err := ioutil.WriteFile(fpath, []byte(`<b class="py-2 px-1">`), 0644); err != nil { // size changes
+		t.Fatal(err)
+	}
+	if !c.ShouldPurgeKey("py-2") {
+		t.Errorf("with no interval the files should not be rescanned without Refresh")
+	}
+	if err := c.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if c.ShouldPurgeKey("py-2") {
+		t.Errorf("missing py-2 after Refresh")
+	}
+
+}
+
+func TestWalkParallel(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "TestWalkParallel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 50; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("d%d", i%5))
+		os.MkdirAll(sub, 0755)
+		content := fmt.Sprintf(`<b class="px-%d bg-{{.C%d}}-500">`, i, i)
+		if err := ioutil.WriteFile(filepath.Join(sub, fmt.Sprintf("f%02d.gohtml", i)), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var seqDyn, parDyn []Dynamic
+
+	seq := NewScanner(nil)
+	seq.SetDynamicFunc(func(d Dynamic) { seqDyn = append(seqDyn, d) })
+	if err := filepath.Walk(dir, seq.WalkFunc(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	par := NewScanner(nil)
+	par.SetDynamicFunc(func(d Dynamic) { parDyn = append(parDyn, d) })
+	if err := par.WalkParallel(context.Background(), 4, nil, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(seq.Map(), par.Map()) {
+		t.Errorf("maps differ:\n%v\n%v", seq.Map(), par.Map())
+	}
+	if len(parDyn) != 50 || !reflect.DeepEqual(seqDyn, parDyn) {
+		t.Errorf("dynamics differ:\n%v\n%v", seqDyn, parDyn)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := NewScanner(nil).WalkParallel(ctx, 4, nil, dir); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	if err := NewScanner(nil).WalkParallel(context.Background(), 4, nil, filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+
+}
+
+func TestWalkFS(t *testing.T) {
+
+	fsys := fstest.MapFS{
+		"templates/a.gohtml":     {Data: []byte(`<b class="{{if .X}}px-1{{end}}">`)},
+		"templates/sub/b.html":   {Data: []byte(`<b class="py-2">`)},
+		"templates/sub/c.txt":    {Data: []byte(`<b class="p-1">`)},
+		"other/d.html":           {Data: []byte(`<b class="m-1">`)},
+		"templates/sub/e.gotmpl": {Data: []byte(`{{define "x"}}<i class="w-1/2">{{end}}`)},
+	}
+	ruleNames := map[string]struct{}{"px-1": {}, "py-2": {}, "w-1/2": {}, "p-1": {}, "m-1": {}}
+	want := Map{"px-1": {}, "py-2": {}, "w-1/2": {}}
+
+	s := NewScanner(ruleNames)
+	if err := s.WalkFS(context.Background(), 2, fsys, nil, "templates"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.Map(), want) {
+		t.Errorf("WalkFS unexpected result: %v", s.Map())
+	}
+	if names := s.Names(); !reflect.DeepEqual(names, []string{"templates/a.gohtml", "templates/sub/b.html", "templates/sub/e.gotmpl"}) {
+		t.Errorf("WalkFS unexpected names: %v", names)
+	}
+
+	s = NewScanner(ruleNames)
+	if err := s.WalkHTTPFileSystem(context.Background(), 2, http.FS(fsys), nil, "/templates"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.Map(), want) {
+		t.Errorf("WalkHTTPFileSystem unexpected result: %v", s.Map())
+	}
+	if names := s.Names(); !reflect.DeepEqual(names, []string{"/templates/a.gohtml", "/templates/sub/b.html", "/templates/sub/e.gotmpl"}) {
+		t.Errorf("WalkHTTPFileSystem unexpected names: %v", names)
+	}
+
+}
+
+func TestWalkOptions(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "TestWalkOptions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"a.html":                   `<b class="px-1">`,
+		"node_modules/x/b.html":    `<b class="bg-red-500">`,
+		"gen/big.html":             `<b class="bg-blue-500">` + strings.Repeat(" ", 1000),
+		"gen/keep.html":            `<b class="text-white">`,
+		"gen/.gitignore":           "*.html\n!keep.html\n",
+		"static/bin.html":          "\x00<b class=\"bg-gray-200\">",
+		"static/vendor/v.html":     `<b class="py-2">`,
+		"static/vendor/.gitignore": "# nothing\n",
+		".gitignore":               "/static/vendor/\n",
+	}
+	for name, content := range files {
+		fpath := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(fpath), 0755)
+		if err := ioutil.WriteFile(fpath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(dir, filepath.Join(dir, "static", "loop")); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := WalkOptions{
+		Exclude:        DefaultExclude,
+		IgnoreFiles:    []string{".gitignore"},
+		MaxFileSize:    500,
+		SkipBinary:     true,
+		FollowSymlinks: true,
+	}
+
+	ruleNames := map[string]struct{}{"px-1": {}, "py-2": {}, "bg-red-500": {}, "bg-blue-500": {}, "bg-gray-200": {}, "text-white": {}}
+	expected := Map{"px-1": {}, "text-white": {}}
+
+	s := NewScanner(ruleNames)
+	s.SetWalkOptions(opts)
+	if err := s.WalkParallel(context.Background(), 2, nil, dir); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.Map(), expected) {
+		t.Errorf("WalkParallel: expected %v, got %v", expected, s.Map())
+	}
+
+	s = NewScanner(ruleNames)
+	s.SetWalkOptions(opts)
+	if err := filepath.Walk(dir, s.WalkFunc(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.Map(), expected) {
+		t.Errorf("WalkFunc: expected %v, got %v", expected, s.Map())
+	}
+
+	// stat errors are returned, or passed to ErrorFunc, rather than causing a panic
+	missing := filepath.Join(dir, "missing")
+	if err := filepath.Walk(missing, NewScanner(nil).WalkFunc(nil)); !os.IsNotExist(err) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+	var errPaths []string
+	s = NewScanner(nil)
+	s.SetWalkOptions(WalkOptions{ErrorFunc: func(fpath string, err error) error {
+		errPaths = append(errPaths, fpath)
+		return nil
+	}})
+	if err := filepath.Walk(missing, s.WalkFunc(nil)); err != nil {
+		t.Errorf("expected ErrorFunc to suppress error, got %v", err)
+	}
+	if !reflect.DeepEqual(errPaths, []string{missing}) {
+		t.Errorf("unexpected ErrorFunc calls: %v", errPaths)
+	}
+
+}
+
+func TestParseIgnoreRule(t *testing.T) {
+
+	tcs := []struct {
+		pattern string
+		rel     string
+		isDir   bool
+		match   bool
+	}{
+		{"*.min.js", "a/b/c.min.js", false, true},
+		{"*.min.js", "c.js", false, false},
+		{"/static", "static", true, true},
+		{"/static", "a/static", true, false},
+		{"build/", "a/build", true, true},
+		{"build/", "a/build", false, false},
+		{"docs/**/*.html", "docs/a/b/c.html", false, true},
+		{"docs/**/*.html", "docs/c.html", false, true},
+		{"docs/**", "docs/c.html", false, true},
+		{"f[!a-c].txt", "fd.txt", false, true},
+		{"f[!a-c].txt", "fa.txt", false, false},
+		{"f?o", "foo", false, true},
+		{"\\#x", "#x", false, true},
+	}
+
+	for _, tc := range tcs {
+		r, ok := parseIgnoreRule(tc.pattern)
+		if !ok {
+			t.Errorf("%q: not parsed", tc.pattern)
+			continue
+		}
+		if m := matchIgnoreRules([]ignoreRule{r}, tc.rel, tc.isDir, false); m != tc.match {
+			t.Errorf("%q against %q (dir=%v): expected %v, got %v", tc.pattern, tc.rel, tc.isDir, tc.match, m)
+		}
+	}
+
+	for _, line := range []string{"", "   ", "# comment", "!", "/"} {
+		if _, ok := parseIgnoreRule(line); ok {
+			t.Errorf("%q: expected no rule", line)
+		}
+	}
+
+}
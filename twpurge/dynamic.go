@@ -0,0 +1,94 @@
+package twpurge
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Dynamic describes a class-like token built by interpolation, like `bg-{{.Color}}-500`
+// in a Go template or `text-${size}` in a JavaScript template literal.
+// The class names it produces at runtime cannot be known by scanning,
+// so unless they appear elsewhere they will be purged.
+type Dynamic struct {
+	Name    string // file name (empty if the input was not named)
+	Line    int    // 1-based line number, 0 if not known
+	Col     int    // 1-based column, 0 if not known
+	Token   string // the token as it was found, e.g. "bg-{{.Color}}-500"
+	Pattern string // the class names it implies, with each interpolation replaced by "*", e.g. "bg-*-500"
+}
+
+// String returns a message in the form "name:line:col: dynamic class ...".
+func (d Dynamic) String() string {
+	return fmt.Sprintf("%s:%d:%d: dynamic class %q (pattern %q)", d.Name, d.Line, d.Col, d.Token, d.Pattern)
+}
+
+// dynamicPattern returns the pattern for a token containing interpolations
+// (`{{...}}`, `${...}` or a Go format verb like `%s`), or false if tok has none
+// or the result does not look like a class name.
+func dynamicPattern(tok []byte) (string, bool) {
+
+	if bytes.IndexAny(tok, "{%") < 0 { // fast path, every interpolation has one of these
+		return "", false
+	}
+
+	var sb strings.Builder
+	found := false
+	for i := 0; i < len(tok); i++ {
+		n := interpolationLen(tok[i:])
+		if n == 0 && tok[i] == '%' && i+1 < len(tok) && strings.IndexByte("svdqx", tok[i+1]) >= 0 {
+			n = 2
+		}
+		if n > 0 {
+			found = true
+			i += n - 1
+			if !strings.HasSuffix(sb.String(), "*") {
+				sb.WriteByte('*')
+			}
+			continue
+		}
+		if !isClassChar(tok[i]) {
+			return "", false
+		}
+		sb.WriteByte(tok[i])
+	}
+	if !found {
+		return "", false
+	}
+
+	// the interpolation must be attached to a class-like fragment, e.g. "bg-*" but not "*" or "x/*"
+	p := sb.String()
+	if !strings.Contains(p, "-*") && !strings.Contains(p, "*-") && !strings.Contains(p, ":*") {
+		return "", false
+	}
+	return p, true
+}
+
+func isClassChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == ':' || c == '/' || c == '.'
+}
+
+// matchGlob reports whether k matches pattern, where "*" in the pattern matches any
+// sequence of characters (including ":" and "/", unlike path.Match) and all other characters match exactly.
+func matchGlob(pattern, k string) bool {
+	star := strings.IndexByte(pattern, '*')
+	if star < 0 {
+		return pattern == k
+	}
+	if !strings.HasPrefix(k, pattern[:star]) {
+		return false
+	}
+	k = k[star:]
+	parts := strings.Split(pattern[star+1:], "*")
+	for i, part := range parts {
+		if i == len(parts)-1 { // the last part must match the end
+			return strings.HasSuffix(k, part)
+		}
+		j := strings.Index(k, part)
+		if j < 0 {
+			return false
+		}
+		k = k[j+len(part):]
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+package twpurge
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// ignoreRule is one line of a .gitignore-style file
+type ignoreRule struct {
+	re      *regexp.Regexp // matched against the slash-separated path relative to the directory the rule is from
+	negate  bool           // line started with "!"
+	dirOnly bool           // line ended with "/"
+}
+
+// parseIgnoreRule parses a .gitignore-style pattern, returns false for blank lines and comments
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+
+	var r ignoreRule
+
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return r, false
+	}
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return r, false
+	}
+
+	// a pattern with a slash (other than at the end) is relative to the directory,
+	// otherwise it can match at any depth
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	var sb strings.Builder
+	sb.WriteString("^")
+	if !anchored {
+		sb.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case strings.HasPrefix(line[i:], "**/"):
+			sb.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(line[i:], "/**") && i+3 == len(line):
+			sb.WriteString("/.*")
+			i += 2
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		case c == '[':
+			if end := strings.IndexByte(line[i:], ']'); end > 0 {
+				class := line[i+1 : i+end]
+				if strings.HasPrefix(class, "!") {
+					class = "^" + class[1:]
+				}
+				sb.WriteString("[" + class + "]")
+				i += end
+			} else {
+				sb.WriteString(regexp.QuoteMeta("["))
+			}
+		case c == '\\' && i+1 < len(line):
+			i++
+			sb.WriteString(regexp.QuoteMeta(line[i : i+1]))
+		default:
+			sb.WriteString(regexp.QuoteMeta(line[i : i+1]))
+		}
+	}
+	sb.WriteString("$")
+
+	re, err := regexp.Compile(sb.String())
+	if err != nil { // e.g. bad character class, treat the line as not matching anything like git does
+		return r, false
+	}
+	r.re = re
+	return r, true
+}
+
+// readIgnoreRules reads a .gitignore-style file
+func readIgnoreRules(r io.Reader) ([]ignoreRule, error) {
+	var ret []ignoreRule
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		if rule, ok := parseIgnoreRule(s.Text()); ok {
+			ret = append(ret, rule)
+		}
+	}
+	return ret, s.Err()
+}
+
+// matchIgnoreRules applies rules in order to a slash-separated relative path, the last matching rule wins.
+// The ignored result is unchanged if no rule matches.
+func matchIgnoreRules(rules []ignoreRule, rel string, isDir bool, ignored bool) bool {
+	for _, r := range rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if r.re.MatchString(rel) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
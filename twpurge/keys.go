@@ -0,0 +1,177 @@
+package twpurge
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ReadKeysText reads purge keys from r, one per line, as written by `gotailwindcss purgescan -o keys.txt`.
+// Blank lines and lines starting with "#" are ignored.
+func ReadKeysText(r io.Reader) (Map, error) {
+	ret := make(Map)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ret[line] = struct{}{}
+	}
+	return ret, s.Err()
+}
+
+// ReadKeysJSON reads purge keys from r, either an array of strings as written by
+// `gotailwindcss purgescan -o keys.json`, or an object whose names are the keys.
+func ReadKeysJSON(r io.Reader) (Map, error) {
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	b = bytes.TrimSpace(b)
+
+	ret := make(Map)
+
+	if bytes.HasPrefix(b, []byte("{")) {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(b, &obj); err != nil {
+			return nil, err
+		}
+		for k := range obj {
+			ret[k] = struct{}{}
+		}
+		return ret, nil
+	}
+
+	var keys []string
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		ret[k] = struct{}{}
+	}
+	return ret, nil
+}
+
+// ReadKeysGo reads purge keys from Go source, as written by `gotailwindcss purgescan -o keys.go`.
+// The keys of every serialized KeySet string literal, the string keys of every map literal and the
+// string elements of every slice or array literal in the file's variable and constant declarations
+// are returned.  The source is parsed, not executed.
+func ReadKeysGo(r io.Reader) (Map, error) {
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", b, parser.SkipObjectResolution)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(Map)
+	// add adds the key from a string literal, or the keys if it is a serialized KeySet,
+	// only the latter if keySetOnly is true
+	add := func(e ast.Expr, keySetOnly bool) error {
+		lit, ok := e.(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			return nil
+		}
+		k, err := strconv.Unquote(lit.Value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fset.Position(lit.Pos()), err)
+		}
+		if strings.HasPrefix(k, keySetMagic) {
+			ks, err := ParseKeySet([]byte(k))
+			if err != nil {
+				return fmt.Errorf("%s: %w", fset.Position(lit.Pos()), err)
+			}
+			ret.Merge(ks.Map())
+			return nil
+		}
+		if !keySetOnly {
+			ret[k] = struct{}{}
+		}
+		return nil
+	}
+
+	for _, decl := range f.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || (gd.Tok != token.VAR && gd.Tok != token.CONST) {
+			continue
+		}
+		ast.Inspect(gd, func(n ast.Node) bool {
+			if err != nil {
+				return false
+			}
+			if lit, ok := n.(*ast.BasicLit); ok {
+				err = add(lit, true)
+				return false
+			}
+			cl, ok := n.(*ast.CompositeLit)
+			if !ok {
+				return true
+			}
+			_, isMap := cl.Type.(*ast.MapType)
+			_, isArray := cl.Type.(*ast.ArrayType)
+			for _, elt := range cl.Elts {
+				if kv, ok := elt.(*ast.KeyValueExpr); ok && isMap {
+					err = add(kv.Key, false)
+				} else if isArray {
+					err = add(elt, false)
+				}
+				if err != nil {
+					break
+				}
+			}
+			return false
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ret, nil
+}
+
+// ReadKeysFile reads a purge key file, choosing the format from the extension:
+// .json (see ReadKeysJSON), .go (see ReadKeysGo) or anything else as text (see ReadKeysText),
+// unless the file is a serialized KeySet.
+func ReadKeysFile(fpath string) (Map, error) {
+
+	b, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	var m Map
+	switch {
+	case bytes.HasPrefix(b, []byte(keySetMagic)):
+		var ks *KeySet
+		ks, err = ParseKeySet(b)
+		if err == nil {
+			m = ks.Map()
+		}
+	case strings.EqualFold(filepath.Ext(fpath), ".json"):
+		m, err = ReadKeysJSON(bytes.NewReader(b))
+	case strings.EqualFold(filepath.Ext(fpath), ".go"):
+		m, err = ReadKeysGo(bytes.NewReader(b))
+	default:
+		m, err = ReadKeysText(bytes.NewReader(b))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fpath, err)
+	}
+	return m, nil
+}
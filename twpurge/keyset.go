@@ -0,0 +1,232 @@
+package twpurge
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// KeySet is an immutable, compact set of purge keys which can be queried without building a map.
+// Its serialized form (see Bytes and ParseKeySet) stores the keys sorted and prefix-compressed,
+// with a restart point every few keys so lookups are a binary search over the restart points
+// followed by a short linear scan.  This is much smaller to embed in a Go program than a map
+// literal and is cheap to load.  KeySet implements Checker and is safe for concurrent use.
+//
+// The serialized format is:
+//
+//	"TWKS" 0x01                        magic and version
+//	uvarint count                      number of keys
+//	uvarint restartInterval            number of keys between restart points
+//	uvarint restartCount
+//	restartCount * uint32 (LE)         offset of each restart point, relative to the first entry
+//	count * entry                      uvarint shared prefix length, uvarint suffix length, suffix
+//
+// The shared prefix length is always zero at a restart point.
+type KeySet struct {
+	raw      []byte // the serialized form
+	data     []byte // the entries
+	restarts []byte // restartCount * 4 bytes
+	count    int
+	interval int
+}
+
+const keySetMagic = "TWKS\x01"
+
+const keySetRestartInterval = 16
+
+// NewKeySet returns a KeySet with the keys of m.
+func NewKeySet(m Map) *KeySet {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ks, err := ParseKeySet(encodeKeySet(keys, keySetRestartInterval))
+	if err != nil {
+		panic(err) // should not be possible
+	}
+	return ks
+}
+
+func encodeKeySet(keys []string, interval int) []byte {
+
+	var entries []byte
+	var restarts []uint32
+	var tmp [binary.MaxVarintLen64]byte
+	prev := ""
+
+	for i, k := range keys {
+		shared := 0
+		if i%interval == 0 {
+			restarts = append(restarts, uint32(len(entries)))
+		} else {
+			for shared < len(prev) && shared < len(k) && prev[shared] == k[shared] {
+				shared++
+			}
+		}
+		entries = append(entries, tmp[:binary.PutUvarint(tmp[:], uint64(shared))]...)
+		entries = append(entries, tmp[:binary.PutUvarint(tmp[:], uint64(len(k)-shared))]...)
+		entries = append(entries, k[shared:]...)
+		prev = k
+	}
+
+	ret := []byte(keySetMagic)
+	ret = append(ret, tmp[:binary.PutUvarint(tmp[:], uint64(len(keys)))]...)
+	ret = append(ret, tmp[:binary.PutUvarint(tmp[:], uint64(interval))]...)
+	ret = append(ret, tmp[:binary.PutUvarint(tmp[:], uint64(len(restarts)))]...)
+	for _, r := range restarts {
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], r)
+		ret = append(ret, b[:]...)
+	}
+	return append(ret, entries...)
+}
+
+// ParseKeySet returns a KeySet which reads from b, as produced by KeySet.Bytes.
+// The header is checked but b is not copied, so it must not be modified afterward.
+func ParseKeySet(b []byte) (*KeySet, error) {
+
+	raw := b
+	if !strings.HasPrefix(string(b), keySetMagic) {
+		return nil, errors.New("twpurge: not a key set")
+	}
+	b = b[len(keySetMagic):]
+
+	var hdr [3]uint64
+	for i := range hdr {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errors.New("twpurge: key set header truncated")
+		}
+		hdr[i] = v
+		b = b[n:]
+	}
+	count, interval, nrestarts := hdr[0], hdr[1], hdr[2]
+	// every entry takes at least two bytes, so bounding count and nrestarts by the data length
+	// (and interval to an int32) also keeps the arithmetic below from overflowing
+	if interval == 0 || interval > math.MaxInt32 || count > uint64(len(b)) || nrestarts > uint64(len(b))/4 ||
+		nrestarts != (count+interval-1)/interval {
+		return nil, fmt.Errorf("twpurge: bad key set header (count=%d, interval=%d, restarts=%d)", count, interval, nrestarts)
+	}
+
+	return &KeySet{
+		raw:      raw,
+		restarts: b[:nrestarts*4],
+		data:     b[nrestarts*4:],
+		count:    int(count),
+		interval: int(interval),
+	}, nil
+}
+
+// MustParseKeySet is like ParseKeySet but panics on error.  It is used by generated code.
+func MustParseKeySet(s string) *KeySet {
+	ks, err := ParseKeySet([]byte(s))
+	if err != nil {
+		panic(err)
+	}
+	return ks
+}
+
+// Bytes returns the serialized form of the KeySet, it must not be modified.
+func (ks *KeySet) Bytes() []byte {
+	return ks.raw
+}
+
+// Len returns the number of keys.
+func (ks *KeySet) Len() int {
+	return ks.count
+}
+
+// Has returns true if k is in the set.
+func (ks *KeySet) Has(k string) bool {
+
+	nrestarts := len(ks.restarts) / 4
+	if nrestarts == 0 {
+		return false
+	}
+
+	// find the last restart point whose key is <= k
+	i := sort.Search(nrestarts, func(i int) bool {
+		_, suffix, _ := ks.entry(ks.restart(i))
+		return string(suffix) > k
+	}) - 1
+	if i < 0 {
+		return false
+	}
+
+	var arr [128]byte
+	buf := arr[:0]
+	off := ks.restart(i)
+	for j := 0; j < ks.interval && i*ks.interval+j < ks.count; j++ {
+		shared, suffix, next := ks.entry(off)
+		if shared > len(buf) || next < 0 {
+			return false // corrupt
+		}
+		buf = append(buf[:shared], suffix...)
+		switch c := strings.Compare(string(buf), k); {
+		case c == 0:
+			return true
+		case c > 0:
+			return false
+		}
+		off = next
+	}
+	return false
+}
+
+// ShouldPurgeKey implements Checker.
+func (ks *KeySet) ShouldPurgeKey(k string) bool {
+	return !ks.Has(k)
+}
+
+// Each calls fn with each key in sorted order until fn returns false.
+func (ks *KeySet) Each(fn func(k string) bool) {
+	var buf []byte
+	off := 0
+	for i := 0; i < ks.count; i++ {
+		shared, suffix, next := ks.entry(off)
+		if shared > len(buf) || next < 0 {
+			return // corrupt
+		}
+		buf = append(buf[:shared], suffix...)
+		if !fn(string(buf)) {
+			return
+		}
+		off = next
+	}
+}
+
+// Map returns a new Map with the keys.
+func (ks *KeySet) Map() Map {
+	ret := make(Map, ks.count)
+	ks.Each(func(k string) bool {
+		ret[k] = struct{}{}
+		return true
+	})
+	return ret
+}
+
+func (ks *KeySet) restart(i int) int {
+	return int(binary.LittleEndian.Uint32(ks.restarts[i*4:]))
+}
+
+// entry decodes the entry at off, next is the offset of the following entry or -1 if the data is corrupt
+func (ks *KeySet) entry(off int) (shared int, suffix []byte, next int) {
+	if off < 0 || off >= len(ks.data) {
+		return 0, nil, -1
+	}
+	b := ks.data[off:]
+	s, n1 := binary.Uvarint(b)
+	if n1 <= 0 || s > uint64(len(ks.data)) { // a prefix longer than the data is corrupt, and may not fit in an int
+		return 0, nil, -1
+	}
+	l, n2 := binary.Uvarint(b[n1:])
+	if n2 <= 0 || uint64(len(b)-n1-n2) < l {
+		return 0, nil, -1
+	}
+	start := n1 + n2
+	return int(s), b[start : start+int(l)], off + start + int(l)
+}
@@ -0,0 +1,136 @@
+package twpurge
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// List is a set of purge keys given as exact keys, glob patterns and regular expressions.
+// It is used for safelists and blocklists, see ListChecker.
+// The zero value is an empty List ready to use.
+type List struct {
+	exact   map[string]struct{}
+	globs   []string
+	regexps []*regexp.Regexp
+}
+
+// NewList returns a List with the entries provided, see Add.
+func NewList(entries ...string) (*List, error) {
+	var l List
+	for _, e := range entries {
+		if err := l.Add(e); err != nil {
+			return nil, err
+		}
+	}
+	return &l, nil
+}
+
+// Add adds an entry to the List.  An entry enclosed in slashes like `/^bg-(red|blue)-\d+$/`
+// is a regular expression (unanchored unless it says otherwise), an entry containing "*" is a glob
+// pattern like "bg-*-500" or "md:*" where "*" matches any sequence of characters, and anything else
+// is an exact key like "sm:px-1".
+func (l *List) Add(entry string) error {
+	switch {
+	case len(entry) >= 2 && strings.HasPrefix(entry, "/") && strings.HasSuffix(entry, "/"):
+		re, err := regexp.Compile(entry[1 : len(entry)-1])
+		if err != nil {
+			return err
+		}
+		l.regexps = append(l.regexps, re)
+	case strings.Contains(entry, "*"):
+		l.globs = append(l.globs, entry)
+	default:
+		if l.exact == nil {
+			l.exact = make(map[string]struct{})
+		}
+		l.exact[entry] = struct{}{}
+	}
+	return nil
+}
+
+// Match returns true if k matches any entry in the List.  A nil List matches nothing.
+func (l *List) Match(k string) bool {
+	if l == nil {
+		return false
+	}
+	if _, ok := l.exact[k]; ok {
+		return true
+	}
+	for _, g := range l.globs {
+		if matchGlob(g, k) {
+			return true
+		}
+	}
+	for _, re := range l.regexps {
+		if re.MatchString(k) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchKeys returns a Map of the keys from ruleNames that match the List.
+// This is used to expand glob patterns and regular expressions into the actual keys,
+// e.g. to add a safelist to the output of a Scanner.
+func (l *List) MatchKeys(ruleNames map[string]struct{}) Map {
+	ret := make(Map)
+	for k := range ruleNames {
+		if l.Match(k) {
+			ret[k] = struct{}{}
+		}
+	}
+	return ret
+}
+
+// ReadList reads a List with one entry per line, see AddFrom.
+func ReadList(r io.Reader) (*List, error) {
+	var l List
+	if err := l.AddFrom(r); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// AddFrom reads entries from r, one per line, and calls Add with each.  Leading and trailing
+// whitespace is ignored, as are blank lines and lines beginning with "#".
+func (l *List) AddFrom(r io.Reader) error {
+	s := bufio.NewScanner(r)
+	line := 0
+	for s.Scan() {
+		line++
+		e := strings.TrimSpace(s.Text())
+		if e == "" || strings.HasPrefix(e, "#") {
+			continue
+		}
+		if err := l.Add(e); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	return s.Err()
+}
+
+// ListChecker wraps a Checker with a safelist and a blocklist.
+// Keys matching Blocklist are always purged, otherwise keys matching Safelist
+// are never purged, and anything else is left up to Checker.
+type ListChecker struct {
+	Checker   Checker // underlying Checker, if nil then only keys matching Blocklist are purged
+	Safelist  *List   // keys which should never be purged, e.g. classes which only appear at runtime
+	Blocklist *List   // keys which should always be purged, takes precedence over Safelist
+}
+
+// ShouldPurgeKey implements Checker.
+func (c *ListChecker) ShouldPurgeKey(k string) bool {
+	if c.Blocklist.Match(k) {
+		return true
+	}
+	if c.Safelist.Match(k) {
+		return false
+	}
+	if c.Checker == nil {
+		return false
+	}
+	return c.Checker.ShouldPurgeKey(k)
+}
@@ -0,0 +1,77 @@
+package twpurge
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Occurrence records where a purge key was found.
+type Occurrence struct {
+	Key     string `json:"key"`
+	Name    string `json:"name"`              // file name (empty if the input was not named)
+	Line    int    `json:"line"`              // 1-based line number, 0 if not known
+	Col     int    `json:"col"`               // 1-based column, 0 if not known
+	Pattern string `json:"pattern,omitempty"` // if the key was kept because of a dynamic class (see SetKeepDynamic), its pattern
+}
+
+// String returns a message in the form "name:line:col: key".
+func (o Occurrence) String() string {
+	if o.Pattern != "" {
+		return fmt.Sprintf("%s:%d:%d: %s (dynamic class pattern %q)", o.Name, o.Line, o.Col, o.Key, o.Pattern)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", o.Name, o.Line, o.Col, o.Key)
+}
+
+// SetRecordOccurrences with true causes the Scanner to record where each key is found,
+// see Occurrences and OccurrenceIndex.  It applies to content scanned after the call.
+// Line and column are only known if the Tokenizer implements PosTokenizer.
+func (s *Scanner) SetRecordOccurrences(record bool) {
+	s.recordOccs = record
+}
+
+// Occurrences returns where key was found by all previous Scan calls, ordered by
+// name, line and column.  It returns nil unless SetRecordOccurrences was enabled.
+func (s *Scanner) Occurrences(key string) []Occurrence {
+	var ret []Occurrence
+	for _, fr := range s.files {
+		for _, o := range fr.occs {
+			if o.Key == key {
+				ret = append(ret, o)
+			}
+		}
+	}
+	sortOccurrences(ret)
+	return ret
+}
+
+// OccurrenceIndex returns where each key was found by all previous Scan calls, with the
+// occurrences of each key ordered by name, line and column.  Keys in the Map which were
+// scanned before SetRecordOccurrences was enabled are not included.
+func (s *Scanner) OccurrenceIndex() map[string][]Occurrence {
+	ret := make(map[string][]Occurrence)
+	for _, fr := range s.files {
+		for _, o := range fr.occs {
+			ret[o.Key] = append(ret[o.Key], o)
+		}
+	}
+	for _, occs := range ret {
+		sortOccurrences(occs)
+	}
+	return ret
+}
+
+func sortOccurrences(occs []Occurrence) {
+	sort.Slice(occs, func(i, j int) bool {
+		a, b := occs[i], occs[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		if a.Col != b.Col {
+			return a.Col < b.Col
+		}
+		return a.Key < b.Key
+	})
+}
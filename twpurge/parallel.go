@@ -0,0 +1,179 @@
+package twpurge
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// WalkParallel walks each root like filepath.Walk and scans the files which match fnmatch
+// (MatchDefault if nil) using n goroutines, or runtime.NumCPU() if n is less than 1.
+//
+// Results are merged in the order the files are encountered by the walk, so the outcome,
+// including the order of calls to the func set with SetDynamicFunc, is the same as scanning
+// the files one at a time.  The first error encountered stops the scan and is returned,
+// as does cancelling ctx, in which case ctx.Err() is returned.  Files scanned before
+// the scan is stopped remain in the Map.
+func (s *Scanner) WalkParallel(ctx context.Context, n int, fnmatch func(fn string) bool, roots ...string) error {
+	return s.walkParallel(ctx, osWalkFS{}, n, fnmatch, roots)
+}
+
+// WalkFS is like WalkParallel but walks and reads files from fsys, e.g. templates
+// embedded with //go:embed, so a program can compute its purge keys at startup.
+// If no roots are given, "." is used.  Files are recorded with their fsys path as the name.
+func (s *Scanner) WalkFS(ctx context.Context, n int, fsys fs.FS, fnmatch func(fn string) bool, roots ...string) error {
+	if len(roots) == 0 {
+		roots = []string{"."}
+	}
+	return s.walkParallel(ctx, ioWalkFS{fsys: fsys}, n, fnmatch, roots)
+}
+
+// WalkHTTPFileSystem is like WalkParallel but walks and reads files from hfs.
+// If no roots are given, "/" is used.  Files are recorded with their hfs path as the name.
+func (s *Scanner) WalkHTTPFileSystem(ctx context.Context, n int, hfs http.FileSystem, fnmatch func(fn string) bool, roots ...string) error {
+	if len(roots) == 0 {
+		roots = []string{"/"}
+	}
+	return s.walkParallel(ctx, httpWalkFS{hfs: hfs}, n, fnmatch, roots)
+}
+
+func (s *Scanner) walkParallel(ctx context.Context, wfs walkFS, n int, fnmatch func(fn string) bool, roots []string) error {
+
+	if n < 1 {
+		n = runtime.NumCPU()
+	}
+	if fnmatch == nil {
+		fnmatch = MatchDefault
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	type job struct {
+		i     int
+		fpath string
+	}
+	type result struct {
+		i     int
+		fpath string
+		fr    *fileResult
+		err   error
+	}
+
+	jobs := make(chan job, n)
+	results := make(chan result, n)
+
+	var firstErr error
+	var errOnce sync.Once
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	go func() {
+		defer close(jobs)
+		i := 0
+		for _, root := range roots {
+			err := s.walk(wfs, root, fnmatch, func(fpath string, info os.FileInfo) error {
+				select {
+				case jobs <- job{i: i, fpath: fpath}:
+					i++
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+			if err != nil {
+				fail(err)
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for w := 0; w < n; w++ {
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if ctx.Err() != nil {
+					continue // drain
+				}
+				fr, err := s.scanFileResult(wfs, j.fpath)
+				select {
+				case results <- result{i: j.i, fpath: j.fpath, fr: fr, err: err}:
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// merge in walk order
+	pending := make(map[int]result)
+	next := 0
+	for r := range results {
+		if r.err != nil {
+			fail(r.err)
+			continue
+		}
+		pending[r.i] = r
+		for {
+			pr, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			if ctx.Err() == nil && pr.fr != nil {
+				s.add(pr.fpath, pr.fr)
+			}
+		}
+	}
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return parent.Err()
+}
+
+// scanFileResult opens and scans a file without modifying s.  The result is nil
+// if the file is skipped because of WalkOptions.SkipBinary.  Errors are passed
+// to WalkOptions.ErrorFunc, if set.
+func (s *Scanner) scanFileResult(wfs walkFS, fpath string) (*fileResult, error) {
+	fr, err := s.scanFileResult1(wfs, fpath)
+	if err != nil && s.walkOptions.ErrorFunc != nil {
+		return nil, s.walkOptions.ErrorFunc(fpath, err)
+	}
+	return fr, err
+}
+
+func (s *Scanner) scanFileResult1(wfs walkFS, fpath string) (*fileResult, error) {
+	f, err := wfs.open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if s.walkOptions.SkipBinary {
+		var binary bool
+		r, binary, err = peekBinary(f)
+		if err != nil {
+			return nil, err
+		}
+		if binary {
+			return nil, nil
+		}
+	}
+	return s.scanResult(fpath, s.TokenizerFunc(fpath)(r))
+}
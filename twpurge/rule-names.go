@@ -14,11 +14,41 @@ type purgeKeyMapper interface {
 	PurgeKeyMap() map[string]struct{}
 }
 
+type purgeKeySetter interface {
+	PurgeKeySet() *KeySet
+}
+
+// ruleNameSet is a set of rule names, implemented by *KeySet and mapRuleNames
+type ruleNameSet interface {
+	Has(k string) bool
+	Len() int
+	Each(fn func(k string) bool)
+}
+
+type mapRuleNames map[string]struct{}
+
+func (m mapRuleNames) Has(k string) bool {
+	_, ok := m[k]
+	return ok
+}
+
+func (m mapRuleNames) Len() int {
+	return len(m)
+}
+
+func (m mapRuleNames) Each(fn func(k string) bool) {
+	for k := range m {
+		if !fn(k) {
+			return
+		}
+	}
+}
+
 // FIXME: this should probably be called RuleNamesFromDist, and document the idea of "rule names" vs "purge keys".
 // PurgeKeysFromDist runs PurgeKeysFromReader on the appropriate(s) file from the dist.
 // A check is done to see if Dist implements interface { PurgeKeyMap() map[string]struct{} }
-// and this is used if avialable.  Otherwise the appropriate files(s) are processed from
-// the dist using PurgeKeysFromReader.
+// or interface { PurgeKeySet() *KeySet } and this is used if avialable.  Otherwise the appropriate files(s) are processed from
+// the dist using PurgeKeysFromReader.  The map returned may be shared and must not be modified.
 func PurgeKeysFromDist(dist Dist) (map[string]struct{}, error) {
 
 	pkmr, ok := dist.(purgeKeyMapper)
@@ -26,6 +56,10 @@ func PurgeKeysFromDist(dist Dist) (map[string]struct{}, error) {
 		return pkmr.PurgeKeyMap(), nil
 	}
 
+	if pks, ok := dist.(purgeKeySetter); ok {
+		return pks.PurgeKeySet().Map(), nil
+	}
+
 	f, err := dist.OpenDist("utilities")
 	if err != nil {
 		return nil, err
@@ -0,0 +1,245 @@
+package twpurge
+
+import (
+	"bytes"
+	"io"
+)
+
+// MatchBinding is a filename matcher function which will return true for files
+// ending in .html, .vugu, .jsx or .vue, which are scanned with NewBindingTokenizer by default.
+var MatchBinding = MatchExt(".html", ".vugu", ".jsx", ".vue")
+
+// NewBindingTokenizer returns a Tokenizer which understands the JavaScript expressions
+// used for dynamic class bindings in Vue, Vugu, JSX, Alpine.js and htmx, e.g.
+// `:class="{ 'bg-red-500': err, 'text-white': !ok }"`, `x-bind:class="open ? 'block' : 'hidden'"`
+// and `className={clsx('a', b && 'p-4')}`.
+//
+// Each token from the DefaultTokenizer is further split on JavaScript punctuation
+// (braces, parens, brackets, commas, operators), which never appears in class names.
+// Interpolations like `${size}` and `{{color}}` are kept intact as part of the token when
+// attached to a class-like fragment, as in `text-${size}` or `bg-{{color}}-500`.  Otherwise
+// the token is split on them, so `{{if .A}}font-bold{{end}}` and `{{x}}m-1` give the classes.
+// An interpolation containing spaces, like `bg-{{ .Color }}-500`, is joined back into one token
+// if it is closed within the next few tokens and the result is a dynamic class (the tokens
+// it is joined from are also returned), otherwise `{{` or `${` is not treated as one.
+// For a token containing a colon, the text before the first and last colons is
+// returned as well, covering unquoted object keys (`{hidden:!open}`) and
+// htmx class-tools timings (`classes="add bg-red-500:1s"`).
+func NewBindingTokenizer(r io.Reader) *BindingTokenizer {
+	return &BindingTokenizer{t: NewDefaultTokenizer(r)}
+}
+
+// BindingTokenizer implements Tokenizer for markup with JavaScript class bindings.
+type BindingTokenizer struct {
+	t         *DefaultTokenizer
+	ahead     []bindingToken // DefaultTokenizer tokens read while looking for the end of an interpolation
+	pending   []bindingPart
+	line, col int // position of the last token returned
+}
+
+type bindingToken struct {
+	b         []byte
+	line, col int
+	err       error
+}
+
+type bindingPart struct {
+	off       int // within the DefaultTokenizer token
+	b         []byte
+	line, col int // position of the DefaultTokenizer token, set by NextToken
+}
+
+// maxInterpolationTokens is how many tokens are read looking for the end of an interpolation
+// containing spaces, like `{{ .Color }}`, before deciding it is not one
+const maxInterpolationTokens = 8
+
+// NextToken implements Tokenizer.
+func (t *BindingTokenizer) NextToken() ([]byte, error) {
+	for len(t.pending) == 0 {
+		tok := t.next()
+		if tok.err != nil {
+			return nil, tok.err
+		}
+		toks := []bindingToken{tok}
+		if end := openInterpolation(tok.b); end != nil {
+			toks = t.joinInterpolation(tok, end)
+		}
+		t.pending = t.pending[:0]
+		if len(toks) > 1 {
+			// the joined token is only used if it is a dynamic class, the tokens it was joined
+			// from are split as usual so e.g. the quoted classes in `${ ok ? 'a' : 'b' }` are found
+			var joined []byte
+			for _, jt := range toks {
+				joined = append(joined, jt.b...)
+			}
+			if _, ok := dynamicPattern(joined); ok {
+				t.pending = append(t.pending, bindingPart{b: joined, line: tok.line, col: tok.col})
+			}
+		}
+		for _, jt := range toks {
+			n := len(t.pending)
+			t.pending = splitBinding(t.pending, jt.b)
+			for i := n; i < len(t.pending); i++ {
+				t.pending[i].line, t.pending[i].col = jt.line, jt.col
+			}
+		}
+	}
+	p := t.pending[0]
+	t.pending = t.pending[1:]
+	t.line, t.col = p.line, p.col+p.off
+	return p.b, nil
+}
+
+// TokenPos implements PosTokenizer.
+func (t *BindingTokenizer) TokenPos() (line, col int) {
+	return t.line, t.col
+}
+
+// next returns the next DefaultTokenizer token, from those read ahead first
+func (t *BindingTokenizer) next() bindingToken {
+	if len(t.ahead) > 0 {
+		tok := t.ahead[0]
+		t.ahead = t.ahead[1:]
+		return tok
+	}
+	b, err := t.t.NextToken()
+	line, col := t.t.TokenPos()
+	return bindingToken{b: b, line: line, col: col, err: err}
+}
+
+// joinInterpolation returns tok and the following tokens up to the one containing end,
+// which closes an interpolation split by the DefaultTokenizer because of spaces, e.g.
+// `bg-{{`, `.Color`, `}}-500` which joined are `bg-{{.Color}}-500`.  If end does not follow
+// closely, only tok is returned and the tokens read are returned by later calls to next.
+func (t *BindingTokenizer) joinInterpolation(tok bindingToken, end []byte) []bindingToken {
+	tok.b = append([]byte(nil), tok.b...) // reading more tokens reuses the DefaultTokenizer's buffer
+	for i := 0; i < maxInterpolationTokens; i++ {
+		if i == len(t.ahead) {
+			tok, err := t.t.NextToken()
+			line, col := t.t.TokenPos()
+			t.ahead = append(t.ahead, bindingToken{b: append([]byte(nil), tok...), line: line, col: col, err: err})
+		}
+		if t.ahead[i].err != nil {
+			break
+		}
+		if bytes.Contains(t.ahead[i].b, end) {
+			ret := append([]bindingToken{tok}, t.ahead[:i+1]...)
+			t.ahead = t.ahead[i+1:]
+			return ret
+		}
+	}
+	return []bindingToken{tok}
+}
+
+func isBindingBr(c byte) bool {
+	switch c {
+	case '{', '}', '(', ')', '[', ']', ',', ';', '?', '!', '&', '|', '+', '=':
+		return true
+	}
+	return false
+}
+
+// splitBinding appends the parts of b separated by JavaScript punctuation to ret.
+func splitBinding(ret []bindingPart, b []byte) []bindingPart {
+	start := 0
+	for i := 0; i <= len(b); i++ {
+		if i < len(b) {
+			if n := interpolationLen(b[i:]); n > 0 {
+				i += n - 1
+				continue
+			}
+			if !isBindingBr(b[i]) {
+				continue
+			}
+		}
+		part := bytes.TrimLeft(b[start:i], `/\:=`)
+		off := i - len(part)
+		part = bytes.TrimRight(part, `/\:=`)
+		start = i + 1
+		if len(part) == 0 {
+			continue
+		}
+		if bytes.Contains(part, []byte("{{")) || bytes.Contains(part, []byte("${")) {
+			if _, ok := dynamicPattern(part); !ok {
+				ret = splitInterpolations(ret, off, part)
+				continue
+			}
+		}
+		ret = appendBindingPart(ret, off, part)
+	}
+	return ret
+}
+
+// appendBindingPart appends part to ret, and for a part containing a colon,
+// the text before the first and last colons
+func appendBindingPart(ret []bindingPart, off int, part []byte) []bindingPart {
+	ret = append(ret, bindingPart{off: off, b: part})
+	if first := bytes.IndexByte(part, ':'); first > 0 {
+		ret = append(ret, bindingPart{off: off, b: part[:first]})
+		if last := bytes.LastIndexByte(part, ':'); last > first {
+			ret = append(ret, bindingPart{off: off, b: part[:last]})
+		}
+	}
+	return ret
+}
+
+// splitInterpolations appends the text between the interpolations in part to ret, for an
+// interpolation which is not part of a class, like `{{end}}` in `font-bold{{end}}`
+func splitInterpolations(ret []bindingPart, off int, part []byte) []bindingPart {
+	start := 0
+	for i := 0; i <= len(part); i++ {
+		n := 0
+		if i < len(part) {
+			if n = interpolationLen(part[i:]); n == 0 {
+				continue
+			}
+		}
+		frag := bytes.TrimLeft(part[start:i], `/\:=`)
+		fragOff := off + i - len(frag)
+		frag = bytes.TrimRight(frag, `/\:=`)
+		if len(frag) > 0 {
+			ret = appendBindingPart(ret, fragOff, frag)
+		}
+		if n > 0 {
+			i += n - 1
+		}
+		start = i + 1
+	}
+	return ret
+}
+
+// openInterpolation returns the end delimiter of an interpolation in b which is not closed, or nil if there isn't one.
+func openInterpolation(b []byte) []byte {
+	for i := 0; i < len(b); i++ {
+		if n := interpolationLen(b[i:]); n > 0 {
+			i += n - 1
+			continue
+		}
+		switch {
+		case bytes.HasPrefix(b[i:], []byte("${")):
+			return []byte("}")
+		case bytes.HasPrefix(b[i:], []byte("{{")):
+			return []byte("}}")
+		}
+	}
+	return nil
+}
+
+// interpolationLen returns the length of the `${...}` or `{{...}}` at the start of b, or 0 if there isn't one
+// (including if it is not closed).
+func interpolationLen(b []byte) int {
+	var end []byte
+	switch {
+	case bytes.HasPrefix(b, []byte("${")):
+		end = []byte("}")
+	case bytes.HasPrefix(b, []byte("{{")):
+		end = []byte("}}")
+	default:
+		return 0
+	}
+	n := bytes.Index(b[2:], end)
+	if n < 0 {
+		return 0
+	}
+	return n + 2 + len(end)
+}
@@ -0,0 +1,247 @@
+package twpurge
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+)
+
+// GoSourceConfig controls which string literals in Go source code are tokenized.
+// The zero value tokenizes every string literal in the file.
+//
+// Setting Funcs and/or Fields restricts tokenization to literals that appear in the
+// arguments of calls to the named functions or in values assigned to the named struct
+// fields, which reduces false positives from unrelated strings.
+type GoSourceConfig struct {
+	// Funcs lists function names whose arguments are tokenized.  A name with a
+	// package or receiver qualifier like "fmt.Sprintf" matches only that call,
+	// whereas an unqualified name like "Class" matches Class(...) and x.Class(...).
+	Funcs []string
+
+	// Fields lists struct field names whose values are tokenized, both in
+	// composite literals like Button{Class: "..."} and assignments like b.Class = "...".
+	Fields []string
+}
+
+// NewGoSourceTokenizer returns a Tokenizer for Go source code which tokenizes the
+// contents of every string literal.  It is the same as GoSourceConfig{}.NewTokenizer(r).
+func NewGoSourceTokenizer(r io.Reader) *GoSourceTokenizer {
+	return GoSourceConfig{}.NewTokenizer(r)
+}
+
+// TokenizerFunc returns a function suitable for Scanner.AddTokenizerFunc which uses this config.
+func (c GoSourceConfig) TokenizerFunc() func(r io.Reader) Tokenizer {
+	return func(r io.Reader) Tokenizer { return c.NewTokenizer(r) }
+}
+
+// NewTokenizer returns a Tokenizer which reads Go source code from r.
+// The source is parsed with go/parser and the string literals selected by the config
+// (including raw strings) are split on whitespace into tokens.
+// Concatenations of constant strings like "bg-" + "red-500" are joined before tokenizing,
+// including references to string constants declared in the same file.
+// If the source cannot be parsed, every string literal found by go/scanner is tokenized.
+func (c GoSourceConfig) NewTokenizer(r io.Reader) *GoSourceTokenizer {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return &GoSourceTokenizer{chunkTokenizer{err: err}}
+	}
+	return &GoSourceTokenizer{newChunkTokenizer(b, c.chunks(b))}
+}
+
+// GoSourceTokenizer implements Tokenizer for Go source code.
+type GoSourceTokenizer struct {
+	chunkTokenizer
+}
+
+func (c GoSourceConfig) chunks(b []byte) []chunk {
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", b, parser.SkipObjectResolution)
+	if err != nil {
+		return goScanStrings(b)
+	}
+
+	w := goSourceWalker{
+		fset:   fset,
+		consts: goStringConsts(f),
+		funcs:  make(map[string]bool, len(c.Funcs)),
+		fields: make(map[string]bool, len(c.Fields)),
+	}
+	for _, fn := range c.Funcs {
+		w.funcs[fn] = true
+	}
+	for _, fn := range c.Fields {
+		w.fields[fn] = true
+	}
+
+	if len(w.funcs) == 0 && len(w.fields) == 0 {
+		w.collect(f)
+	} else {
+		ast.Inspect(f, w.inspectRestricted)
+	}
+
+	sort.SliceStable(w.chunks, func(i, j int) bool { return w.chunks[i].off < w.chunks[j].off })
+	return w.chunks
+}
+
+type goSourceWalker struct {
+	fset   *token.FileSet
+	consts map[string]string // string constants declared in the file
+	funcs  map[string]bool
+	fields map[string]bool
+	chunks []chunk
+}
+
+// inspectRestricted finds the calls, composite literal elements and assignments selected
+// by funcs and fields and collects the strings under them.
+func (w *goSourceWalker) inspectRestricted(n ast.Node) bool {
+	switch n := n.(type) {
+	case *ast.CallExpr:
+		if w.funcs[goExprName(n.Fun, true)] || w.funcs[goExprName(n.Fun, false)] {
+			for _, arg := range n.Args {
+				w.collect(arg)
+			}
+			return false
+		}
+	case *ast.KeyValueExpr:
+		if id, ok := n.Key.(*ast.Ident); ok && w.fields[id.Name] {
+			w.collect(n.Value)
+			return false
+		}
+	case *ast.AssignStmt:
+		if len(n.Lhs) == len(n.Rhs) {
+			for i, lhs := range n.Lhs {
+				if sel, ok := lhs.(*ast.SelectorExpr); ok && w.fields[sel.Sel.Name] {
+					w.collect(n.Rhs[i])
+				}
+			}
+		}
+	}
+	return true
+}
+
+// collect adds a chunk for each string under n, joining constant concatenations.
+func (w *goSourceWalker) collect(n ast.Node) {
+	ast.Inspect(n, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.ImportSpec:
+			return false // import paths are never class names
+		case *ast.Field:
+			return false // neither are struct tags
+		case *ast.BinaryExpr:
+			if s, ok := w.fold(n); ok {
+				w.add(n.Pos(), s)
+				return false
+			}
+		case *ast.BasicLit:
+			if s, ok := w.fold(n); ok {
+				w.add(n.Pos(), s)
+			}
+		}
+		return true
+	})
+}
+
+func (w *goSourceWalker) add(pos token.Pos, s string) {
+	w.chunks = append(w.chunks, chunk{off: w.fset.Position(pos).Offset + 1, text: []byte(s)})
+}
+
+// fold returns the string value of e if it is a string literal, a string constant
+// declared in the file or a concatenation of these.
+func (w *goSourceWalker) fold(e ast.Expr) (string, bool) {
+	switch e := e.(type) {
+	case *ast.BasicLit:
+		if e.Kind != token.STRING {
+			return "", false
+		}
+		s, err := strconv.Unquote(e.Value)
+		return s, err == nil
+	case *ast.Ident:
+		s, ok := w.consts[e.Name]
+		return s, ok
+	case *ast.ParenExpr:
+		return w.fold(e.X)
+	case *ast.BinaryExpr:
+		if e.Op != token.ADD {
+			return "", false
+		}
+		x, ok := w.fold(e.X)
+		if !ok {
+			return "", false
+		}
+		y, ok := w.fold(e.Y)
+		if !ok {
+			return "", false
+		}
+		return x + y, true
+	}
+	return "", false
+}
+
+// goStringConsts returns the constants in f which are declared with a single string literal value.
+func goStringConsts(f *ast.File) map[string]string {
+	ret := make(map[string]string)
+	for _, decl := range f.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.CONST {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			vs := spec.(*ast.ValueSpec)
+			if len(vs.Names) != len(vs.Values) {
+				continue
+			}
+			for i, name := range vs.Names {
+				lit, ok := vs.Values[i].(*ast.BasicLit)
+				if !ok || lit.Kind != token.STRING {
+					continue
+				}
+				if s, err := strconv.Unquote(lit.Value); err == nil {
+					ret[name.Name] = s
+				}
+			}
+		}
+	}
+	return ret
+}
+
+// goExprName returns the name of a called function, e.g. "Class" or, with qualified set, "fmt.Sprintf".
+func goExprName(e ast.Expr, qualified bool) string {
+	switch e := e.(type) {
+	case *ast.Ident:
+		return e.Name
+	case *ast.SelectorExpr:
+		if !qualified {
+			return e.Sel.Name
+		}
+		if x := goExprName(e.X, true); x != "" {
+			return x + "." + e.Sel.Name
+		}
+	}
+	return ""
+}
+
+// goScanStrings returns a chunk for every string literal in b, without parsing.
+func goScanStrings(b []byte) (ret []chunk) {
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(b))
+	var s scanner.Scanner
+	s.Init(file, b, nil, 0)
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			return
+		}
+		if tok != token.STRING {
+			continue
+		}
+		if v, err := strconv.Unquote(lit); err == nil {
+			ret = append(ret, chunk{off: file.Offset(pos) + 1, text: []byte(v)})
+		}
+	}
+}
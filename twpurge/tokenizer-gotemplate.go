@@ -0,0 +1,213 @@
+package twpurge
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"text/template/parse"
+)
+
+// MatchGoTemplate is a filename matcher function which will return true for files
+// ending in .gohtml, .gotmpl or .tmpl.
+var MatchGoTemplate = MatchExt(".gohtml", ".gotmpl", ".tmpl")
+
+// NewGoTemplateTokenizer returns a Tokenizer for Go text/template and html/template source.
+// The template is parsed with text/template/parse and every text node is tokenized,
+// including those in all branches of if, range and with actions and in each defined template,
+// so e.g. `class="{{if .Active}}bg-blue-500{{else}}bg-gray-200{{end}}"` yields
+// both bg-blue-500 and bg-gray-200.  String constants inside actions are tokenized as well.
+// If the template cannot be parsed, the actions are blanked out and the remaining
+// text is tokenized as-is, so a syntax error does not cause classes to be missed.
+func NewGoTemplateTokenizer(r io.Reader) *GoTemplateTokenizer {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return &GoTemplateTokenizer{chunkTokenizer{err: err}}
+	}
+	return &GoTemplateTokenizer{newChunkTokenizer(b, goTemplateChunks(b))}
+}
+
+// GoTemplateTokenizer implements Tokenizer for Go templates.
+type GoTemplateTokenizer struct {
+	chunkTokenizer
+}
+
+func goTemplateChunks(b []byte) []chunk {
+
+	tree := parse.New("")
+	tree.Mode = parse.SkipFuncCheck
+	treeSet := make(map[string]*parse.Tree)
+	tree, err := tree.Parse(string(b), "", "", treeSet)
+	if err != nil {
+		return []chunk{{text: blankGoTemplateActions(b)}}
+	}
+
+	w := goTemplateWalker{src: b}
+	seen := make(map[*parse.Tree]bool, len(treeSet)+1)
+	for _, t := range append([]*parse.Tree{tree}, treeSetTrees(treeSet)...) {
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+		w.walk(t.Root)
+	}
+
+	sort.SliceStable(w.chunks, func(i, j int) bool { return w.chunks[i].off < w.chunks[j].off })
+	return w.chunks
+}
+
+// treeSetTrees returns the trees sorted by name so walking them is deterministic.
+func treeSetTrees(treeSet map[string]*parse.Tree) []*parse.Tree {
+	names := make([]string, 0, len(treeSet))
+	for name := range treeSet {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ret := make([]*parse.Tree, 0, len(names))
+	for _, name := range names {
+		ret = append(ret, treeSet[name])
+	}
+	return ret
+}
+
+type goTemplateWalker struct {
+	src    []byte
+	chunks []chunk
+}
+
+func (w *goTemplateWalker) walk(n parse.Node) {
+	switch n := n.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for i, c := range n.Nodes {
+			w.walk(c)
+			if _, ok := c.(*parse.TextNode); !ok {
+				var next parse.Node
+				if i < len(n.Nodes)-1 {
+					next = n.Nodes[i+1]
+				}
+				w.interpolation(c, next)
+			}
+		}
+	case *parse.TextNode:
+		w.chunks = append(w.chunks, chunk{off: int(n.Pos), text: n.Text})
+	case *parse.StringNode:
+		w.chunks = append(w.chunks, chunk{off: int(n.Pos) + 1, text: []byte(n.Text)})
+	case *parse.ActionNode:
+		w.walk(n.Pipe)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Cmds {
+			w.walk(c)
+		}
+	case *parse.CommandNode:
+		for _, a := range n.Args {
+			w.walk(a)
+		}
+	case *parse.ChainNode:
+		w.walk(n.Node)
+	case *parse.IfNode:
+		w.walkBranch(&n.BranchNode)
+	case *parse.RangeNode:
+		w.walkBranch(&n.BranchNode)
+	case *parse.WithNode:
+		w.walkBranch(&n.BranchNode)
+	case *parse.TemplateNode:
+		w.walk(n.Pipe)
+	}
+}
+
+// interpolation is called with each action (or if, range, with or template node) and the node following
+// it in the same list, if any.  If the action is in the middle of a word, like `bg-{{.Color}}-500`,
+// it adds a chunk with the whole word so it comes out as a single token and the Scanner can see
+// the class is dynamic.  The word is found in the source, so an action at the start or end of a
+// branch, like `{{if .X}}bg-{{.Color}}{{end}}`, is handled too.  Actions which would not survive
+// tokenizing as-is (because of spaces or quotes) are replaced by "{{}}".
+func (w *goTemplateWalker) interpolation(action, next parse.Node) {
+
+	pos := int(action.Position())
+	if pos > len(w.src) {
+		return
+	}
+	start := bytes.LastIndex(w.src[:pos], []byte("{{"))
+	if start < 0 {
+		return
+	}
+	end := -1 // unknown
+	switch action.(type) {
+	case *parse.ActionNode, *parse.TemplateNode:
+		if n := bytes.Index(w.src[pos:], []byte("}}")); n >= 0 {
+			end = pos + n + 2
+		}
+	default: // the end of if, range and with is only known from the text after it
+		if tn, ok := next.(*parse.TextNode); ok {
+			end = int(tn.Pos)
+		}
+	}
+
+	// the word runs up to the end of the text before (or another action) and from the start of the text after
+	off := start
+	if !bytes.HasPrefix(w.src[start:], []byte("{{- ")) {
+		for off > 0 && !isbr(w.src[off-1]) && w.src[off-1] != '}' {
+			off--
+		}
+	}
+	tail := w.src[off:start]
+	var head []byte
+	if end >= 0 && !bytes.HasSuffix(w.src[:end], []byte(" -}}")) {
+		i := end
+		for i < len(w.src) && !isbr(w.src[i]) && w.src[i] != '{' {
+			i++
+		}
+		head = w.src[end:i]
+	}
+	if len(tail) == 0 && len(head) == 0 {
+		return
+	}
+
+	as := action.String()
+	if _, ok := action.(*parse.ActionNode); !ok || strings.IndexFunc(as, func(r rune) bool { return r < 128 && isbr(byte(r)) }) >= 0 {
+		as = "{{}}"
+	}
+	text := make([]byte, 0, len(tail)+len(as)+len(head))
+	text = append(append(append(text, tail...), as...), head...)
+	w.chunks = append(w.chunks, chunk{off: off, text: text})
+}
+
+func (w *goTemplateWalker) walkBranch(n *parse.BranchNode) {
+	w.walk(n.Pipe)
+	w.walk(n.List)
+	w.walk(n.ElseList)
+}
+
+// blankGoTemplateActions returns a copy of b with everything from each "{{" to the following "}}"
+// replaced with spaces, so offsets in the result line up with the original.
+func blankGoTemplateActions(b []byte) []byte {
+	ret := make([]byte, len(b))
+	copy(ret, b)
+	for i := 0; i < len(ret); {
+		start := bytes.Index(ret[i:], []byte("{{"))
+		if start < 0 {
+			break
+		}
+		start += i
+		end := bytes.Index(ret[start+2:], []byte("}}"))
+		if end < 0 {
+			end = len(ret)
+		} else {
+			end += start + 4
+		}
+		for j := start; j < end; j++ {
+			if ret[j] != '\n' {
+				ret[j] = ' '
+			}
+		}
+		i = end
+	}
+	return ret
+}
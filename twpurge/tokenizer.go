@@ -3,7 +3,9 @@ package twpurge
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"io"
+	"sort"
 )
 
 // Tokenizer returns the next token from a markup file.
@@ -11,6 +13,38 @@ type Tokenizer interface {
 	NextToken() ([]byte, error) // returns a token or error (not both), io.EOF indicates end of stream
 }
 
+// PosTokenizer is implemented by Tokenizers which can report where in the input
+// the token most recently returned by NextToken was found.
+// All of the Tokenizers in this package implement it.
+type PosTokenizer interface {
+	Tokenizer
+	TokenPos() (line, col int) // 1-based line and column (column counted in bytes)
+}
+
+// pos tracks a line and column as input is consumed
+type pos struct {
+	line, col int
+}
+
+func (p *pos) advance(b []byte) {
+	for _, c := range b {
+		if c == '\n' {
+			p.line++
+			p.col = 1
+		} else {
+			p.col++
+		}
+	}
+}
+
+// add returns the position of something at p2 (1-based, relative to p) in terms of the input p is in.
+func (p pos) add(p2 pos) pos {
+	if p2.line <= 1 {
+		return pos{line: p.line, col: p.col + p2.col - 1}
+	}
+	return pos{line: p.line + p2.line - 1, col: p2.col}
+}
+
 func isbr(c byte) bool {
 	switch c {
 	// NOTE: We're going to assume ASCII is fine here - we could do some UTF-8 fanciness but I don't know
@@ -23,6 +57,7 @@ func isbr(c byte) bool {
 }
 
 func NewDefaultTokenizer(r io.Reader) *DefaultTokenizer {
+	t := &DefaultTokenizer{pos: pos{line: 1, col: 1}}
 	s := bufio.NewScanner(r)
 	s.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
 
@@ -31,6 +66,8 @@ func NewDefaultTokenizer(r io.Reader) *DefaultTokenizer {
 		// 	log.Printf("Split(data=%q, atEOF=%v) returning (advance=%d, token=%q, err=%v)", data, atEOF, advance, token, err)
 		// }()
 
+		orig := data
+
 		// consume any break text
 		for len(data) > 0 {
 			if !isbr(data[0]) {
@@ -49,6 +86,7 @@ func NewDefaultTokenizer(r io.Reader) *DefaultTokenizer {
 				if i > 0 {
 					token = data[:i]
 				}
+				t.consume(orig[:advance], data[:i])
 				advance += i
 				return
 			}
@@ -63,21 +101,31 @@ func NewDefaultTokenizer(r io.Reader) *DefaultTokenizer {
 			if i > 0 {
 				token = data[:i]
 			}
+			t.consume(orig[:advance], data[:i])
 			advance += i
 			return
 		}
 
 		// not end of stream, tell it we need more (advance may have been incremented above)
+		t.consume(orig[:advance], nil)
 		return advance, nil, nil
 	})
-	return &DefaultTokenizer{
-		s: s,
-	}
+	t.s = s
+	return t
 }
 
 // DefaultTokenizer implements Tokenizer with a sensible default tokenization.
 type DefaultTokenizer struct {
-	s *bufio.Scanner
+	s      *bufio.Scanner
+	pos    pos // position of the input not yet consumed by the split func
+	tokPos pos // position of the last token found by the split func
+}
+
+// consume is called by the split func with the break bytes skipped and the token after them
+func (t *DefaultTokenizer) consume(skipped, token []byte) {
+	t.pos.advance(skipped)
+	t.tokPos = t.pos
+	t.pos.advance(token)
 }
 
 func (t *DefaultTokenizer) NextToken() ([]byte, error) {
@@ -87,7 +135,10 @@ func (t *DefaultTokenizer) NextToken() ([]byte, error) {
 		if len(b) == 0 {
 			continue
 		}
-		b = bytes.Trim(b, `/\:=`)
+		lt := len(b)
+		b = bytes.TrimLeft(b, `/\:=`)
+		t.tokPos.col += lt - len(b)
+		b = bytes.TrimRight(b, `/\:=`)
 		return b, nil
 	}
 	if err := t.s.Err(); err != nil {
@@ -96,3 +147,79 @@ func (t *DefaultTokenizer) NextToken() ([]byte, error) {
 	}
 	return nil, io.EOF
 }
+
+// TokenPos implements PosTokenizer.
+func (t *DefaultTokenizer) TokenPos() (line, col int) {
+	return t.tokPos.line, t.tokPos.col
+}
+
+// chunk is a piece of text to be tokenized which was found at offset off in the original input.
+type chunk struct {
+	off  int
+	text []byte
+}
+
+// chunkTokenizer returns the tokens from each chunk in turn, using a BindingTokenizer for each.
+// It is used by tokenizers which first extract the relevant text from a file.
+type chunkTokenizer struct {
+	chunks     []chunk
+	lineStarts []int // offset of the start of each line in the original input
+	cur        *BindingTokenizer
+	curPos     pos // position of the current chunk in the original input
+	err        error
+}
+
+func newChunkTokenizer(src []byte, chunks []chunk) chunkTokenizer {
+	lineStarts := []int{0}
+	for i, c := range src {
+		if c == '\n' {
+			lineStarts = append(lineStarts, i+1)
+		}
+	}
+	return chunkTokenizer{chunks: chunks, lineStarts: lineStarts}
+}
+
+// NextToken implements Tokenizer.
+func (t *chunkTokenizer) NextToken() ([]byte, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	for {
+		if t.cur == nil {
+			if len(t.chunks) == 0 {
+				return nil, io.EOF
+			}
+			t.cur = NewBindingTokenizer(bytes.NewReader(t.chunks[0].text))
+			t.curPos = t.offsetPos(t.chunks[0].off)
+			t.chunks = t.chunks[1:]
+		}
+		b, err := t.cur.NextToken()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				t.cur = nil
+				continue
+			}
+			return nil, err
+		}
+		return b, nil
+	}
+}
+
+// TokenPos implements PosTokenizer.
+func (t *chunkTokenizer) TokenPos() (line, col int) {
+	if t.cur == nil {
+		return 0, 0
+	}
+	var p pos
+	p.line, p.col = t.cur.TokenPos()
+	p = t.curPos.add(p)
+	return p.line, p.col
+}
+
+func (t *chunkTokenizer) offsetPos(off int) pos {
+	i := sort.SearchInts(t.lineStarts, off+1) - 1
+	if i < 0 {
+		return pos{line: 1, col: 1}
+	}
+	return pos{line: i + 1, col: off - t.lineStarts[i] + 1}
+}
@@ -3,8 +3,10 @@ package twpurge
 import (
 	"errors"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
@@ -13,16 +15,6 @@ import (
 // but then it stays in a file and is used to filter results quickly.  This way you get purged files
 // in development (one benefit of this is you don't have different styles in dev and production).
 
-// From a naming perspective, breaking up the tasks of "scanning for things to not purge" and "implementing the ShouldPurgeKey method"
-// should probably be two different things...
-// twpurge.Scanner - scans text to exract purge keys
-// twpurge.Checker - just has ShouldPurgeKey
-// twpurge.CheckerFunc - implement ShouldPurgeKey as a function
-// twpurge.Map - cast map[string]struct{}{} to type that implements Checker
-
-// TODO: PurgeDir - reads directory, can reload upon demand (first call to ShouldPurgeKey) after X time, by default only loads first time
-// Should we/can we abstract this out to some sort of reload function that gets invoked?  Or is that too much, maybe we just go simple.
-
 // type Purger struct {
 // }
 
@@ -50,11 +42,6 @@ import (
 // 	ParsePurgeKeys(r io.Reader, purgeKeyMap map[string]struct{}) error
 // }
 
-// read a single file
-// read a tree
-// read a tree every X seconds
-// each needs to provide a ShouldPurgeKey(k string) bool
-
 // Checker is implemented by something that can answer the question "should this CSS rule be purged from the output because it is unused".
 type Checker interface {
 	ShouldPurgeKey(k string) bool
@@ -71,6 +58,7 @@ func (m Map) ShouldPurgeKey(k string) bool {
 	return !ok
 }
 
+// Merge adds all of the keys in fromMap to m.
 func (m Map) Merge(fromMap Map) {
 	for k, v := range fromMap {
 		m[k] = v
@@ -81,16 +69,63 @@ func (m Map) Merge(fromMap Map) {
 // to be preserved when purging.  The scanning is intentionally naive in order to keep
 // it's rules simple to understand and reasonbly performant. (TODO: explain more)
 type Scanner struct {
+	tokenizerFunc  func(r io.Reader) Tokenizer
+	tokenizerFuncs []matchTokenizerFunc // registered with AddTokenizerFunc, checked from last to first
+	ruleNames      ruleNameSet          // nil keeps all tokens
+	m              Map
+	files          map[string]*fileResult // the result of scanning each name, "" for unnamed Scan calls
+	refs           map[string]int         // the number of entries in files which have each key in m
+	dynamicFunc    func(d Dynamic)
+	keepDynamic    bool
+	recordOccs     bool
+	dynamicKeys    map[string][]string // rule names matching each pattern, when keepDynamic is set
+	mods           uint64              // incremented each time a key is added to or removed from m
+	walkOptions    WalkOptions
+}
+
+// fileResult is what was found by scanning one file
+type fileResult struct {
+	keys     Map
+	dynamics []Dynamic
+	occs     []Occurrence // only if SetRecordOccurrences is enabled
+}
+
+type matchTokenizerFunc struct {
+	fnmatch       func(fn string) bool
 	tokenizerFunc func(r io.Reader) Tokenizer
-	ruleNames     map[string]struct{}
-	m             Map
 }
 
+// NewScanner returns a Scanner which keeps only the tokens found in ruleNames, or all tokens if ruleNames is nil.
+// HTML, Vue, Vugu and JSX files (see MatchBinding) are tokenized with NewBindingTokenizer,
+// Go template files (see MatchGoTemplate) with NewGoTemplateTokenizer,
+// .go files with NewGoSourceTokenizer and everything else uses NewDefaultTokenizer.
 func NewScanner(ruleNames map[string]struct{}) *Scanner {
-	return &Scanner{ruleNames: ruleNames}
+	if ruleNames == nil {
+		return newScanner(nil)
+	}
+	return newScanner(mapRuleNames(ruleNames))
+}
+
+// NewScannerFromKeySet is like NewScanner but keeps only the tokens found in ks,
+// without building a map of the rule names.
+func NewScannerFromKeySet(ks *KeySet) *Scanner {
+	return newScanner(ks)
 }
 
+func newScanner(ruleNames ruleNameSet) *Scanner {
+	s := &Scanner{ruleNames: ruleNames}
+	s.AddTokenizerFunc(MatchBinding, func(r io.Reader) Tokenizer { return NewBindingTokenizer(r) })
+	s.AddTokenizerFunc(MatchGoTemplate, func(r io.Reader) Tokenizer { return NewGoTemplateTokenizer(r) })
+	s.AddTokenizerFunc(MatchExt(".go"), func(r io.Reader) Tokenizer { return NewGoSourceTokenizer(r) })
+	return s
+}
+
+// NewScannerFromDist returns a Scanner which keeps only the tokens which are rule names in dist,
+// see PurgeKeysFromDist.  If dist has a KeySet (see NewScannerFromKeySet), no map is built.
 func NewScannerFromDist(dist Dist) (*Scanner, error) {
+	if pks, ok := dist.(purgeKeySetter); ok {
+		return NewScannerFromKeySet(pks.PurgeKeySet()), nil
+	}
 	pkmap, err := PurgeKeysFromDist(dist)
 	if err != nil {
 		return nil, err
@@ -100,63 +135,301 @@ func NewScannerFromDist(dist Dist) (*Scanner, error) {
 
 var defaultTokenizerFunc = func(r io.Reader) Tokenizer { return NewDefaultTokenizer(r) }
 
-func (s *Scanner) Scan(r io.Reader) error {
+// SetTokenizerFunc sets the function used to create a Tokenizer for content which
+// does not match anything registered with AddTokenizerFunc.  Passing nil restores
+// the default, which uses NewDefaultTokenizer.
+func (s *Scanner) SetTokenizerFunc(f func(r io.Reader) Tokenizer) {
+	s.tokenizerFunc = f
+}
 
-	if s.m == nil {
-		s.m = make(Map, len(s.ruleNames)/16)
+// AddTokenizerFunc registers a function to create a Tokenizer for files whose name matches fnmatch.
+// Registrations are checked starting with the most recently added, so a later call can
+// override an earlier one.  Files that match nothing use the func from SetTokenizerFunc.
+// See also MatchExt.
+func (s *Scanner) AddTokenizerFunc(fnmatch func(fn string) bool, f func(r io.Reader) Tokenizer) {
+	s.tokenizerFuncs = append(s.tokenizerFuncs, matchTokenizerFunc{fnmatch: fnmatch, tokenizerFunc: f})
+}
+
+// TokenizerFunc returns the function that will be used to create a Tokenizer for the file name provided.
+func (s *Scanner) TokenizerFunc(fn string) func(r io.Reader) Tokenizer {
+	for i := len(s.tokenizerFuncs) - 1; i >= 0; i-- {
+		mtf := s.tokenizerFuncs[i]
+		if mtf.fnmatch(fn) {
+			return mtf.tokenizerFunc
+		}
 	}
+	if s.tokenizerFunc != nil {
+		return s.tokenizerFunc
+	}
+	return defaultTokenizerFunc
+}
 
+// Scan reads r using the Tokenizer from SetTokenizerFunc (or the default) and adds
+// any purge keys found to the Map.
+func (s *Scanner) Scan(r io.Reader) error {
 	tf := s.tokenizerFunc
 	if tf == nil {
 		tf = defaultTokenizerFunc
 	}
-	t := tf(r)
+	return s.scan("", tf(r))
+}
+
+// ScanNamed is like Scan but uses the name to choose a Tokenizer, as registered with
+// AddTokenizerFunc.  The name is usually a file name but need not exist on disk.
+func (s *Scanner) ScanNamed(name string, r io.Reader) error {
+	return s.scan(name, s.TokenizerFunc(name)(r))
+}
+
+// SetDynamicFunc sets a function which is called for each dynamic class found during scanning,
+// e.g. `bg-{{.Color}}-500`, usually to print a warning.  See Dynamic.
+func (s *Scanner) SetDynamicFunc(f func(d Dynamic)) {
+	s.dynamicFunc = f
+}
+
+// SetKeepDynamic with true causes every rule name matching the pattern of a dynamic class
+// to be added to the Map, e.g. finding `bg-{{.Color}}-500` keeps bg-red-500, bg-blue-500, etc.
+// This makes the output larger but ensures classes built at runtime are not purged.
+// It has no effect if the Scanner was created without rule names.
+func (s *Scanner) SetKeepDynamic(keep bool) {
+	s.keepDynamic = keep
+}
+
+// Dynamics returns the dynamic classes found by all previous Scan calls,
+// ordered by name, line and column.
+func (s *Scanner) Dynamics() []Dynamic {
+	var ret []Dynamic
+	for _, fr := range s.files {
+		ret = append(ret, fr.dynamics...)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		a, b := ret[i], ret[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Col < b.Col
+	})
+	return ret
+}
+
+// scan reads the tokens from t and adds what it finds to the entry for name.
+// Keys found before an error are still added.
+func (s *Scanner) scan(name string, t Tokenizer) error {
+	fr, err := s.scanResult(name, t)
+	s.add(name, fr)
+	return err
+}
+
+// scanResult reads the tokens from t and returns what it finds, without modifying s.
+func (s *Scanner) scanResult(name string, t Tokenizer) (*fileResult, error) {
+
+	fr := &fileResult{keys: make(Map)}
+
+	pt, _ := t.(PosTokenizer)
 
 	for {
 		b, err := t.NextToken()
 		if err != nil {
 			if errors.Is(err, io.EOF) {
-				return nil
+				return fr, nil
 			}
-			return err
+			return fr, err
+		}
+		if pattern, ok := dynamicPattern(b); ok {
+			d := Dynamic{Name: name, Token: string(b), Pattern: pattern}
+			if pt != nil {
+				d.Line, d.Col = pt.TokenPos()
+			}
+			fr.dynamics = append(fr.dynamics, d)
+			continue
 		}
 		bstr := string(b) // FIXME: cheating with zero-alloc unsafe cast would be appropriate here
 		found := true
 		if s.ruleNames != nil {
-			_, found = s.ruleNames[bstr]
+			found = s.ruleNames.Has(bstr)
 		}
 		if found {
-			s.m[bstr] = struct{}{}
+			fr.keys[bstr] = struct{}{}
+			if s.recordOccs {
+				o := Occurrence{Key: bstr, Name: name}
+				if pt != nil {
+					o.Line, o.Col = pt.TokenPos()
+				}
+				fr.occs = append(fr.occs, o)
+			}
+		}
+	}
+}
+
+// add merges a scan result into the entry for name, updating the Map and reference counts.
+func (s *Scanner) add(name string, fr *fileResult) {
+
+	if s.m == nil {
+		n := 0
+		if s.ruleNames != nil {
+			n = s.ruleNames.Len() / 16
+		}
+		s.m = make(Map, n)
+	}
+	if s.files == nil {
+		s.files = make(map[string]*fileResult)
+		s.refs = make(map[string]int)
+	}
+
+	for _, d := range fr.dynamics {
+		if s.dynamicFunc != nil {
+			s.dynamicFunc(d)
+		}
+		for _, k := range s.dynamicPatternKeys(d.Pattern) {
+			fr.keys[k] = struct{}{}
+			if s.recordOccs {
+				fr.occs = append(fr.occs, Occurrence{Key: k, Name: d.Name, Line: d.Line, Col: d.Col, Pattern: d.Pattern})
+			}
+		}
+	}
+
+	cur := s.files[name]
+	if cur == nil {
+		cur = &fileResult{keys: make(Map, len(fr.keys))}
+		s.files[name] = cur
+	}
+	cur.dynamics = append(cur.dynamics, fr.dynamics...)
+	cur.occs = append(cur.occs, fr.occs...)
+	for k := range fr.keys {
+		if _, ok := cur.keys[k]; ok {
+			continue
+		}
+		cur.keys[k] = struct{}{}
+		s.refs[k]++
+		if s.refs[k] == 1 {
+			s.m[k] = struct{}{}
+			s.mods++
+		}
+	}
+}
+
+// dynamicPatternKeys returns the rule names that match pattern if SetKeepDynamic is enabled.
+func (s *Scanner) dynamicPatternKeys(pattern string) []string {
+	if !s.keepDynamic || s.ruleNames == nil {
+		return nil
+	}
+	keys, ok := s.dynamicKeys[pattern]
+	if ok {
+		return keys
+	}
+	s.ruleNames.Each(func(k string) bool {
+		if matchGlob(pattern, k) {
+			keys = append(keys, k)
+		}
+		return true
+	})
+	if s.dynamicKeys == nil {
+		s.dynamicKeys = make(map[string][]string)
+	}
+	s.dynamicKeys[pattern] = keys
+	return keys
+}
+
+// Forget removes everything found by scanning name.  Keys are removed
+// from the Map unless they were also found in another name.
+func (s *Scanner) Forget(name string) {
+	cur := s.files[name]
+	if cur == nil {
+		return
+	}
+	delete(s.files, name)
+	for k := range cur.keys {
+		s.refs[k]--
+		if s.refs[k] <= 0 {
+			delete(s.refs, k)
+			delete(s.m, k)
+			s.mods++
 		}
 	}
 }
 
+// Rescan replaces everything found by previously scanning name with the result of
+// scanning r, using the Tokenizer for name.  Keys which no longer appear in any name
+// are removed from the Map.  If an error occurs, the previous result for name is kept.
+func (s *Scanner) Rescan(name string, r io.Reader) error {
+	fr, err := s.scanResult(name, s.TokenizerFunc(name)(r))
+	if err != nil {
+		return err
+	}
+	s.Forget(name)
+	s.add(name, fr)
+	return nil
+}
+
+// RescanFile is like Rescan with the contents of the file at fpath.
+// If the file no longer exists, or is skipped because of WalkOptions.SkipBinary,
+// Forget is called instead.
+func (s *Scanner) RescanFile(fpath string) error {
+	return s.rescanFile(osWalkFS{}, fpath)
+}
+
+func (s *Scanner) rescanFile(wfs walkFS, fpath string) error {
+	fr, err := s.scanFileResult1(wfs, fpath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			s.Forget(fpath)
+			return nil
+		}
+		return err
+	}
+	s.Forget(fpath)
+	if fr != nil {
+		s.add(fpath, fr)
+	}
+	return nil
+}
+
+// Names returns the sorted list of names which have been scanned and not forgotten.
+// Content passed to Scan is recorded with an empty name.
+func (s *Scanner) Names() []string {
+	ret := make([]string, 0, len(s.files))
+	for name := range s.files {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
 func (s *Scanner) ScanFile(fpath string) error {
 	f, err := os.Open(fpath)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	return s.Scan(f)
+	return s.ScanNamed(fpath, f)
 }
 
 // WalkFunc returns a function which can be called by filepath.Walk to scan each matching file encountered.
 // The fnmatch func says which files to scan, if nil is passed then MatchDefault will be used.
+// The WalkOptions are applied relative to the first path the function is called with, which
+// filepath.Walk passes as the root.  Stat errors are returned as-is unless WalkOptions.ErrorFunc says otherwise.
+// The returned function should only be used for one walk.
 func (s *Scanner) WalkFunc(fnmatch func(fn string) bool) filepath.WalkFunc {
 	if fnmatch == nil {
 		fnmatch = MatchDefault
 	}
+	var f *walkFilter
 	return filepath.WalkFunc(func(fpath string, info os.FileInfo, err error) error {
-		if info.IsDir() { // ignore dirs
-			return nil
+		if f == nil {
+			f = newWalkFilter(&s.walkOptions, osWalkFS{}, fpath)
 		}
-		if err != nil { // any stat errors get returned as-is
+		ok, err := f.check(fpath, info, err)
+		if err != nil || !ok || !fnmatch(fpath) {
 			return err
 		}
-		if !fnmatch(fpath) { // ignore if filename doesn't match
-			return nil
+		fr, err := s.scanFileResult(osWalkFS{}, fpath)
+		if err != nil || fr == nil {
+			return err
 		}
-		return s.ScanFile(fpath)
+		s.add(fpath, fr)
+		return nil
 	})
 }
 
@@ -166,16 +439,29 @@ func (s *Scanner) Map() Map {
 }
 
 // MatchDefault is a filename matcher function which will return true for files
-// end in .html, .vugu, .jsx or .vue.
+// end in .html, .vugu, .jsx or .vue, or the Go template extensions .gohtml, .gotmpl or .tmpl.
 var MatchDefault = func(fn string) bool {
 	ext := strings.ToLower(filepath.Ext(fn))
 	switch ext {
-	case ".html", ".vugu", ".jsx", ".vue":
+	case ".html", ".vugu", ".jsx", ".vue", ".gohtml", ".gotmpl", ".tmpl":
 		return true
 	}
 	return false
 }
 
+// MatchExt returns a filename matcher function which returns true for files ending
+// in any of the extensions provided (with leading period, e.g. ".html").  The comparison
+// is not case sensitive.
+func MatchExt(exts ...string) func(fn string) bool {
+	extMap := make(map[string]bool, len(exts))
+	for _, ext := range exts {
+		extMap[strings.ToLower(ext)] = true
+	}
+	return func(fn string) bool {
+		return extMap[strings.ToLower(filepath.Ext(fn))]
+	}
+}
+
 // // Purger can parse markup and accumulate a list of purge keys which can be used to
 // // vet the output of tailwind.Converter to eliminate unused styles.
 // type Purger struct {
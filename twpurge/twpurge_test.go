@@ -1,8 +1,12 @@
 package twpurge
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"reflect"
 	"strings"
 	"testing"
@@ -106,3 +110,607 @@ func TestPurgeKeysFromReader(t *testing.T) {
 	}
 
 }
+
+type upperTokenizer struct {
+	t Tokenizer
+}
+
+func (ut upperTokenizer) NextToken() ([]byte, error) {
+	b, err := ut.t.NextToken()
+	return bytes.ToUpper(b), err
+}
+
+func TestScannerTokenizerFunc(t *testing.T) {
+
+	s := NewScanner(nil)
+	s.AddTokenizerFunc(MatchExt(".up"), func(r io.Reader) Tokenizer {
+		return upperTokenizer{t: NewDefaultTokenizer(r)}
+	})
+
+	if err := s.ScanNamed("a.html", strings.NewReader(`<b class="px-1">`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ScanNamed("b.UP", strings.NewReader(`<b class="py-2">`)); err != nil {
+		t.Fatal(err)
+	}
+
+	m := s.Map()
+	if m.ShouldPurgeKey("px-1") {
+		t.Errorf("px-1 should have been scanned with the default tokenizer")
+	}
+	if m.ShouldPurgeKey("PY-2") {
+		t.Errorf("PY-2 should have been scanned with the registered tokenizer")
+	}
+	if !m.ShouldPurgeKey("py-2") {
+		t.Errorf("py-2 should not have been scanned with the default tokenizer")
+	}
+
+}
+
+func TestGoTemplateTokenizer(t *testing.T) {
+
+	s := NewScanner(nil)
+	err := s.ScanNamed("page.gohtml", strings.NewReader(`{{define "btn"}}<a class="{{if .Active}}bg-blue-500{{else}}bg-gray-200{{end}} px-1">{{end}}
+<div class="{{ $c := "text-white py-2" }}{{ $c }} {{range .Items}}w-1/2{{end}}"></div>
+{{template "btn" .}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := s.Map()
+	for _, k := range []string{"bg-blue-500", "bg-gray-200", "px-1", "text-white", "py-2", "w-1/2"} {
+		if m.ShouldPurgeKey(k) {
+			t.Errorf("missing key %q", k)
+		}
+	}
+	for k := range m {
+		if strings.Contains(k, "{{") || strings.Contains(k, "}}") {
+			t.Errorf("unexpected key %q", k)
+		}
+	}
+
+	// a syntax error should still find classes outside of actions
+	s = NewScanner(nil)
+	err = s.ScanNamed("broken.tmpl", strings.NewReader(`<div class="{{if .X}}p-1{{end}} {{ .Missing "}}">`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Map().ShouldPurgeKey("p-1") {
+		t.Errorf("missing key p-1 from unparsable template")
+	}
+
+}
+
+func TestGoSourceTokenizer(t *testing.T) {
+
+	src := `package ui
+
+import "fmt"
+
+const bg = "bg-"
+
+type Button struct {
+	Class string ` + "`json:\"label\"`" + `
+}
+
+func render(color string) string {
+	b := Button{Class: "px-1 " + "py-2"}
+	b.Class = ` + "`text-white`" + `
+	_ = fmt.Sprintf("<div class=%q>", bg+"red-500")
+	return "w-1/2"
+}
+`
+
+	keys := func(c GoSourceConfig) Map {
+		s := NewScanner(nil)
+		s.AddTokenizerFunc(MatchExt(".go"), c.TokenizerFunc())
+		if err := s.ScanNamed("ui.go", strings.NewReader(src)); err != nil {
+			t.Fatal(err)
+		}
+		return s.Map()
+	}
+
+	m := keys(GoSourceConfig{})
+	for _, k := range []string{"px-1", "py-2", "text-white", "bg-red-500", "w-1/2"} {
+		if m.ShouldPurgeKey(k) {
+			t.Errorf("missing key %q", k)
+		}
+	}
+	for _, k := range []string{"fmt", "json", "label"} {
+		if !m.ShouldPurgeKey(k) {
+			t.Errorf("unexpected key %q", k)
+		}
+	}
+
+	m = keys(GoSourceConfig{Funcs: []string{"fmt.Sprintf"}, Fields: []string{"Class"}})
+	for _, k := range []string{"px-1", "py-2", "text-white", "bg-red-500"} {
+		if m.ShouldPurgeKey(k) {
+			t.Errorf("restricted: missing key %q", k)
+		}
+	}
+	if !m.ShouldPurgeKey("w-1/2") {
+		t.Errorf("restricted: unexpected key w-1/2")
+	}
+
+}
+
+func TestBindingTokenizer(t *testing.T) {
+
+	s := NewScanner(nil)
+	err := s.ScanNamed("comp.vue", strings.NewReader(`<template>
+<div :class="{ 'bg-red-500': err, 'text-white': !ok }" x-bind:class="open?'block':'hidden'"></div>
+<p :class="{underline:!open}" classes="add md:bg-purple-500:1s, remove p-1"></p>
+<b className={clsx('px-1', b && 'py-2')}></b>
+</template>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := s.Map()
+	for _, k := range []string{"bg-red-500", "text-white", "block", "hidden", "underline", "md:bg-purple-500", "p-1", "px-1", "py-2"} {
+		if m.ShouldPurgeKey(k) {
+			t.Errorf("missing key %q", k)
+		}
+	}
+	for k := range m {
+		if strings.ContainsAny(k, "{}()',") {
+			t.Errorf("unexpected key %q", k)
+		}
+	}
+
+	// interpolations not attached to a class are split on
+	s = NewScanner(nil)
+	err = s.ScanNamed("page.html", strings.NewReader(`<b class="{{if .A}}font-bold{{end}}"></b><i class="{{x}}m-1 bg-{{c}}-500"></i>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = s.Map()
+	for _, k := range []string{"font-bold", "m-1"} {
+		if m.ShouldPurgeKey(k) {
+			t.Errorf("missing key %q", k)
+		}
+	}
+	for _, k := range []string{"font-bold{{end}}", "{{x}}m-1"} {
+		if !m.ShouldPurgeKey(k) {
+			t.Errorf("unexpected key %q", k)
+		}
+	}
+
+	// quoted classes inside an interpolation with spaces are found
+	s = NewScanner(nil)
+	err = s.ScanNamed("comp.jsx", strings.NewReader("<b className={`p-4 ${active ? 'bg-blue-500' : 'bg-gray-200'}`}></b>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.ScanNamed("comp.vue", strings.NewReader("<b :class=\"`p-1 ${ok ? 'text-white' : 'underline'}`\"></b>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = s.Map()
+	for _, k := range []string{"p-4", "bg-blue-500", "bg-gray-200", "p-1", "text-white", "underline"} {
+		if m.ShouldPurgeKey(k) {
+			t.Errorf("interpolation: missing key %q", k)
+		}
+	}
+
+}
+
+func TestScannerDynamic(t *testing.T) {
+
+	ruleNames := map[string]struct{}{
+		"bg-red-500": {}, "bg-blue-500": {}, "bg-blue-600": {}, "text-sm": {}, "text-lg": {}, "p-1": {},
+	}
+
+	s := NewScanner(ruleNames)
+	var dlist []Dynamic
+	s.SetDynamicFunc(func(d Dynamic) { dlist = append(dlist, d) })
+	s.SetKeepDynamic(true)
+
+	err := s.ScanNamed("page.gohtml", strings.NewReader(`<div class="p-1">
+  <span class="bg-{{.Color}}-500 x/{{.ID}}">{{.Title}}</span>
+</div>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.ScanNamed("comp.jsx", strings.NewReader("<b className={`text-${size}`}></b>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(dlist) != 2 {
+		t.Fatalf("unexpected dynamics: %v", dlist)
+	}
+	if d := dlist[0]; d.Name != "page.gohtml" || d.Line != 2 || d.Col != 16 || d.Pattern != "bg-*-500" {
+		t.Errorf("unexpected dynamic: %v", d)
+	}
+	if d := dlist[1]; d.Name != "comp.jsx" || d.Line != 1 || d.Col != 16 || d.Pattern != "text-*" {
+		t.Errorf("unexpected dynamic: %v", d)
+	}
+
+	m := s.Map()
+	for _, k := range []string{"p-1", "bg-red-500", "bg-blue-500", "text-sm", "text-lg"} {
+		if m.ShouldPurgeKey(k) {
+			t.Errorf("missing key %q", k)
+		}
+	}
+	if !m.ShouldPurgeKey("bg-blue-600") {
+		t.Errorf("unexpected key bg-blue-600")
+	}
+
+}
+
+func TestScannerDynamicSpaced(t *testing.T) {
+
+	s := NewScanner(map[string]struct{}{"bg-red-500": {}, "bg-red-600": {}, "text-sm": {}})
+	var patterns []string
+	s.SetDynamicFunc(func(d Dynamic) { patterns = append(patterns, d.Pattern) })
+	s.SetKeepDynamic(true)
+
+	// an interpolation with spaces is joined back together, one which is not closed is not an interpolation
+	err := s.ScanNamed("page.html", strings.NewReader(`<div class="bg-{{ .Color }}-500 text-{{ oops"></div>
+<div class="{{ .A | default "bg-red-600" }} {{ index .Classes "text-sm" }}"></div>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(patterns, " ") != "bg-*-500" {
+		t.Errorf("unexpected dynamic patterns %q", patterns)
+	}
+	m := s.Map()
+	if m.ShouldPurgeKey("bg-red-500") || m.ShouldPurgeKey("bg-red-600") || m.ShouldPurgeKey("text-sm") {
+		t.Errorf("unexpected keys %v", m)
+	}
+
+}
+
+func TestScannerDynamicBranch(t *testing.T) {
+
+	s := NewScanner(map[string]struct{}{"bg-red-500": {}, "text-sm": {}, "p-1": {}})
+	var patterns []string
+	s.SetDynamicFunc(func(d Dynamic) { patterns = append(patterns, d.Pattern) })
+
+	// actions at the start or end of a branch are still seen as part of a word
+	err := s.ScanNamed("page.gohtml", strings.NewReader(`<div class="{{if .X}}bg-{{.C}}{{end}}"></div>
+<div class="{{if .X}}text-{{.Size}}{{else}}p-1{{end}}"></div>
+<div class="{{with .Y}}{{.Z}}-sm{{end}}"></div>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"bg-*", "text-*", "*-sm"}
+	if strings.Join(patterns, " ") != strings.Join(want, " ") {
+		t.Errorf("unexpected dynamic patterns %q, expected %q", patterns, want)
+	}
+	if m := s.Map(); m.ShouldPurgeKey("p-1") {
+		t.Errorf("missing key p-1")
+	}
+
+}
+
+func TestTokenPos(t *testing.T) {
+
+	tz := NewBindingTokenizer(strings.NewReader("<a\n  class=\"px-1 :class={'py-2':x}\">"))
+	want := map[string][2]int{"a": {1, 2}, "class": {2, 3}, "px-1": {2, 10}, "py-2": {2, 24}}
+	for {
+		tok, err := tz.NextToken()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			t.Fatal(err)
+		}
+		line, col := tz.TokenPos()
+		if w, ok := want[string(tok)]; ok && (w[0] != line || w[1] != col) {
+			t.Errorf("token %q at %d:%d, expected %d:%d", tok, line, col, w[0], w[1])
+		}
+		delete(want, string(tok)) // only check the first one
+	}
+	if len(want) > 0 {
+		t.Errorf("tokens not found: %v", want)
+	}
+
+}
+
+func TestListChecker(t *testing.T) {
+
+	safelist, err := ReadList(strings.NewReader(`
+# runtime alert classes
+bg-*-500
+/^text-(sm|lg)$/
+md:*
+p-2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocklist, err := NewList("bg-blue-500")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &ListChecker{
+		Checker:   Map{"px-1": {}},
+		Safelist:  safelist,
+		Blocklist: blocklist,
+	}
+
+	for k, purge := range map[string]bool{
+		"px-1":         false, // from Checker
+		"py-2":         true,
+		"bg-red-500":   false,
+		"bg-red-600":   true,
+		"bg-blue-500":  true, // blocklist wins
+		"text-sm":      false,
+		"text-base":    true,
+		"md:w-1/2":     false,
+		"p-2":          false,
+		"p-2.5":        true,
+		"lg:text-sm":   true,
+		"sm:bg-red-50": true,
+	} {
+		if c.ShouldPurgeKey(k) != purge {
+			t.Errorf("ShouldPurgeKey(%q) should have returned %v", k, purge)
+		}
+	}
+
+	if _, err := NewList("/[/"); err == nil {
+		t.Errorf("expected error from bad regexp")
+	}
+
+}
+
+func TestCheckerCombinators(t *testing.T) {
+
+	svc1 := Map{"px-1": {}, "py-2": {}}
+	svc2 := NewSet("py-2", "p-1")
+	blocked := CheckerFunc(func(k string) bool { return k != "px-1" }) // keeps only px-1
+
+	union := Union(svc1, svc2)
+	inter := Intersection(svc1, svc2)
+	notBlocked := Intersection(union, Not(blocked))
+
+	for k, want := range map[string][3]bool{ // union, intersection, notBlocked
+		"px-1": {false, true, true},
+		"py-2": {false, false, false},
+		"p-1":  {false, true, false},
+		"m-1":  {true, true, true},
+	} {
+		if got := [3]bool{union.ShouldPurgeKey(k), inter.ShouldPurgeKey(k), notBlocked.ShouldPurgeKey(k)}; got != want {
+			t.Errorf("key %q: got %v, expected %v", k, got, want)
+		}
+	}
+
+	if !Union().ShouldPurgeKey("p-1") || Intersection().ShouldPurgeKey("p-1") {
+		t.Errorf("unexpected result from empty Union/Intersection")
+	}
+
+	svc2.Remove("p-1")
+	svc2.Merge(Map{"m-1": {}})
+	if !union.ShouldPurgeKey("p-1") || union.ShouldPurgeKey("m-1") {
+		t.Errorf("changes to Set not reflected")
+	}
+	svc2.Replace(nil)
+	if svc2.Len() != 0 || !svc2.ShouldPurgeKey("m-1") {
+		t.Errorf("Replace failed")
+	}
+
+}
+
+func TestScannerRescan(t *testing.T) {
+
+	s := NewScanner(map[string]struct{}{"px-1": {}, "py-2": {}, "p-1": {}, "m-1": {}})
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(s.ScanNamed("a.html", strings.NewReader(`<b class="px-1 py-2">`)))
+	must(s.ScanNamed("b.html", strings.NewReader(`<b class="py-2 p-1">`)))
+
+	check := func(keep ...string) {
+		t.Helper()
+		m := s.Map()
+		if len(m) != len(keep) {
+			t.Errorf("expected %d keys, got %v", len(keep), m)
+		}
+		for _, k := range keep {
+			if m.ShouldPurgeKey(k) {
+				t.Errorf("missing key %q", k)
+			}
+		}
+	}
+	check("px-1", "py-2", "p-1")
+
+	// py-2 is still used by b.html
+	must(s.Rescan("a.html", strings.NewReader(`<b class="px-1">`)))
+	check("px-1", "py-2", "p-1")
+
+	s.Forget("b.html")
+	check("px-1")
+
+	must(s.Rescan("b.html", strings.NewReader(`<b class="m-1">`)))
+	check("px-1", "m-1")
+
+	if names := s.Names(); !reflect.DeepEqual(names, []string{"a.html", "b.html"}) {
+		t.Errorf("unexpected names: %v", names)
+	}
+
+}
+
+func TestScannerOccurrences(t *testing.T) {
+
+	s := NewScanner(map[string]struct{}{"px-1": {}, "py-2": {}, "bg-red-500": {}, "bg-blue-500": {}})
+	s.SetKeepDynamic(true)
+	s.SetRecordOccurrences(true)
+
+	if err := s.ScanNamed("b.html", strings.NewReader("<a class=\"px-1\">\n<b class=\"py-2 px-1\">")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ScanNamed("a.gohtml", strings.NewReader(`<a class="bg-{{.C}}-500">`)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Occurrence{{Key: "px-1", Name: "b.html", Line: 1, Col: 11}, {Key: "px-1", Name: "b.html", Line: 2, Col: 16}}
+	if got := s.Occurrences("px-1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("px-1: expected %v, got %v", want, got)
+	}
+
+	idx := s.OccurrenceIndex()
+	if len(idx) != 4 {
+		t.Errorf("expected 4 keys in index, got %v", idx)
+	}
+	o := idx["bg-red-500"]
+	if len(o) != 1 || o[0].Name != "a.gohtml" || o[0].Line != 1 || o[0].Pattern != "bg-*-500" {
+		t.Errorf("unexpected bg-red-500 occurrences: %v", o)
+	}
+	if o[0].String() != `a.gohtml:1:11: bg-red-500 (dynamic class pattern "bg-*-500")` {
+		t.Errorf("unexpected String: %s", o[0])
+	}
+
+	if err := s.Rescan("b.html", strings.NewReader(`<a class="py-2">`)); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Occurrences("px-1"); len(got) != 0 {
+		t.Errorf("expected px-1 occurrences to be gone after rescan, got %v", got)
+	}
+
+}
+
+func TestReadKeys(t *testing.T) {
+
+	expected := Map{"px-1": {}, "md:bg-purple-500": {}}
+
+	m, err := ReadKeysText(strings.NewReader("# keys\npx-1\n\n md:bg-purple-500 \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("text: expected %v, got %v", expected, m)
+	}
+
+	for _, src := range []string{`["px-1","md:bg-purple-500"]`, `{"px-1":[],"md:bg-purple-500":[{"name":"a.html"}]}`} {
+		m, err = ReadKeysJSON(strings.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(m, expected) {
+			t.Errorf("json %s: expected %v, got %v", src, expected, m)
+		}
+	}
+
+	src := fmt.Sprintf("package x\n\n// PurgeKeyMap is a list of keys which should not be purged from CSS output.\nvar PurgeKeyMap = %#v\n", (map[string]struct{})(expected))
+	m, err = ReadKeysGo(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("go: expected %v, got %v", expected, m)
+	}
+
+	m, err = ReadKeysGo(strings.NewReader("package x\nvar keys = []string{\"px-1\", `md:bg-purple-500`}\nconst note = \"see TWKS format\"\nfunc f() { _ = map[string]int{\"nope\": 1} }\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("go slice: expected %v, got %v", expected, m)
+	}
+
+	if _, err := ReadKeysJSON(strings.NewReader(`[1]`)); err == nil {
+		t.Errorf("expected error for bad json")
+	}
+
+}
+
+func uvarintBytes(v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return b[:binary.PutUvarint(b[:], v)]
+}
+
+func TestKeySet(t *testing.T) {
+
+	m := make(Map)
+	for i := 0; i < 1000; i++ {
+		m[fmt.Sprintf("bg-c%d-%d", i%37, i*100)] = struct{}{}
+	}
+	m["md:px-1"] = struct{}{}
+	m[""] = struct{}{}
+
+	ks, err := ParseKeySet(NewKeySet(m).Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ks.Len() != len(m) {
+		t.Errorf("expected %d keys, got %d", len(m), ks.Len())
+	}
+	for k := range m {
+		if !ks.Has(k) || ks.ShouldPurgeKey(k) {
+			t.Errorf("missing key %q", k)
+		}
+	}
+	for _, k := range []string{"a", "bg-c", "bg-c1-100x", "md:px-2", "zzz", "bg-c0-0 "} {
+		if ks.Has(k) {
+			t.Errorf("unexpected key %q", k)
+		}
+	}
+	if !reflect.DeepEqual(ks.Map(), m) {
+		t.Errorf("Map does not match")
+	}
+	prev := ""
+	ks.Each(func(k string) bool {
+		if k < prev {
+			t.Errorf("keys not sorted: %q after %q", k, prev)
+		}
+		prev = k
+		return true
+	})
+
+	if NewKeySet(nil).Has("") {
+		t.Errorf("empty set should not have any keys")
+	}
+	for _, b := range []string{"", "TWKS", "TWKS\x01\x05\x00\x01", "nope"} {
+		if _, err := ParseKeySet([]byte(b)); err == nil {
+			t.Errorf("%q: expected error", b)
+		}
+	}
+
+	// corrupt entries must not panic: the second one claims a shared prefix of 2^64-1
+	var corrupt []byte
+	for _, v := range []uint64{2, 16, 1} {
+		corrupt = append(corrupt, uvarintBytes(v)...)
+	}
+	corrupt = append(corrupt, 0, 0, 0, 0, 0, 1, 'a')
+	corrupt = append(corrupt, uvarintBytes(math.MaxUint64)...)
+	corrupt = append(corrupt, 1, 'b')
+	cks, err := ParseKeySet(append([]byte(keySetMagic), corrupt...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cks.Has("b") || cks.Has("ab") || len(cks.Map()) != 1 {
+		t.Errorf("corrupt key set: unexpected keys %v", cks.Map())
+	}
+	for _, b := range []string{"TWKS\x01\x01\x01\xff\xff\xff\xff\xff\xff\xff\xff\x7f", "TWKS\x01\x01\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01\x01"} {
+		if _, err := ParseKeySet([]byte(b)); err == nil {
+			t.Errorf("%q: expected error", b)
+		}
+	}
+
+	src := fmt.Sprintf("package x\n\nvar PurgeKeySet = twpurge.MustParseKeySet(purgeKeySetData)\n\nconst purgeKeySetData = %q\n", NewKeySet(m).Bytes())
+	gm, err := ReadKeysGo(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gm, m) {
+		t.Errorf("ReadKeysGo with key set does not match")
+	}
+
+	s := NewScannerFromKeySet(ks)
+	s.SetKeepDynamic(true)
+	if err := s.ScanNamed("a.html", strings.NewReader(`<b class="md:px-1 px-2 bg-c3-{{x}}00">`)); err != nil {
+		t.Fatal(err)
+	}
+	sm := s.Map()
+	if sm.ShouldPurgeKey("md:px-1") || sm.ShouldPurgeKey("bg-c3-300") || !sm.ShouldPurgeKey("px-2") {
+		t.Errorf("unexpected keys from scanner with key set: %v", sm)
+	}
+
+}
@@ -0,0 +1,367 @@
+package twpurge
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// walkFS is a file system that the Scanner can walk and read files from.
+// Implementations exist for the OS file system, io/fs.FS and net/http.FileSystem.
+type walkFS interface {
+	// walk calls fn for each file and directory under root, in lexical order, with the same semantics as filepath.Walk
+	walk(root string, fn filepath.WalkFunc) error
+	open(fpath string) (io.ReadCloser, error)
+}
+
+// osWalkFS is the OS file system
+type osWalkFS struct {
+	followSymlinks bool
+}
+
+func (w osWalkFS) walk(root string, fn filepath.WalkFunc) error {
+	if !w.followSymlinks {
+		return filepath.Walk(root, fn)
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = w.walkFollow(root, info, fn, nil)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+// walkFollow is like filepath.Walk but follows symbolic links, each directory in
+// visited (checked with os.SameFile) is only walked once to avoid loops
+func (w osWalkFS) walkFollow(fpath string, info os.FileInfo, fn filepath.WalkFunc, visited []os.FileInfo) error {
+
+	if !info.IsDir() {
+		return fn(fpath, info, nil)
+	}
+
+	for _, v := range visited {
+		if os.SameFile(v, info) {
+			return nil
+		}
+	}
+	visited = append(visited, info)
+
+	names, err := readDirNames(fpath)
+	err1 := fn(fpath, info, err)
+	if err != nil || err1 != nil {
+		return err1
+	}
+
+	for _, name := range names {
+		fn1 := filepath.Join(fpath, name)
+		fi, err := os.Stat(fn1)
+		if err != nil {
+			if err = fn(fn1, nil, err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+		err = w.walkFollow(fn1, fi, fn, visited)
+		if err != nil {
+			if !fi.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (w osWalkFS) open(fpath string) (io.ReadCloser, error) {
+	return os.Open(fpath)
+}
+
+// ioWalkFS adapts an io/fs.FS
+type ioWalkFS struct {
+	fsys fs.FS
+}
+
+func (w ioWalkFS) walk(root string, fn filepath.WalkFunc) error {
+	return fs.WalkDir(w.fsys, root, func(fpath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fn(fpath, nil, err)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return fn(fpath, nil, err)
+		}
+		return fn(fpath, info, nil)
+	})
+}
+
+func (w ioWalkFS) open(fpath string) (io.ReadCloser, error) {
+	return w.fsys.Open(fpath)
+}
+
+// httpWalkFS adapts a net/http.FileSystem
+type httpWalkFS struct {
+	hfs http.FileSystem
+}
+
+func (w httpWalkFS) walk(root string, fn filepath.WalkFunc) error {
+	info, err := w.stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = w.walkInfo(root, info, fn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func (w httpWalkFS) walkInfo(fpath string, info os.FileInfo, fn filepath.WalkFunc) error {
+
+	if !info.IsDir() {
+		return fn(fpath, info, nil)
+	}
+
+	infos, err := w.readDir(fpath)
+	err1 := fn(fpath, info, err)
+	if err != nil || err1 != nil {
+		// like filepath.Walk, a directory that cannot be read is reported and then skipped
+		return err1
+	}
+
+	for _, fi := range infos {
+		err = w.walkInfo(path.Join(fpath, fi.Name()), fi, fn)
+		if err != nil {
+			if !fi.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (w httpWalkFS) stat(fpath string) (os.FileInfo, error) {
+	f, err := w.hfs.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+func (w httpWalkFS) readDir(fpath string) ([]os.FileInfo, error) {
+	f, err := w.hfs.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	infos, err := f.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (w httpWalkFS) open(fpath string) (io.ReadCloser, error) {
+	return w.hfs.Open(fpath)
+}
+
+// DefaultExclude is a list of directories which rarely contain markup of interest
+// and can be slow to walk, suitable for WalkOptions.Exclude.
+var DefaultExclude = []string{".git/", ".hg/", ".svn/", "node_modules/"}
+
+// WalkOptions controls which files are scanned by the Scanner's directory walking methods
+// (WalkFunc, WalkParallel, WalkFS, WalkHTTPFileSystem and DirChecker polling).
+// The zero value scans every file that matches the fnmatch func and stops at the first error.
+type WalkOptions struct {
+	// Exclude lists .gitignore-style patterns, relative to the root being walked, for files
+	// and directories to skip, e.g. "node_modules/", "*.min.js" or "/static/vendor".
+	// See also DefaultExclude.
+	Exclude []string
+
+	// IgnoreFiles lists the names of .gitignore-style files, e.g. ".gitignore", which are read from
+	// each directory walked and apply to the files under it.  Excluded directories are not walked.
+	IgnoreFiles []string
+
+	// MaxFileSize causes files larger than this many bytes to be skipped, zero means no limit.
+	MaxFileSize int64
+
+	// SkipBinary causes files which contain a NUL byte in their first 512 bytes to be skipped.
+	SkipBinary bool
+
+	// FollowSymlinks causes symbolic links to directories to be walked (OS file system only).
+	// Each directory is walked only once, so symlink loops are not a problem.
+	FollowSymlinks bool
+
+	// ErrorFunc, if not nil, is called with errors encountered while walking, such as a file
+	// or directory that cannot be read.  Returning nil skips that file or directory and continues,
+	// otherwise the walk stops with the error returned.  By default the walk stops with the error.
+	ErrorFunc func(fpath string, err error) error
+}
+
+// SetWalkOptions sets the options used by directory walking methods, see WalkOptions.
+func (s *Scanner) SetWalkOptions(opts WalkOptions) {
+	s.walkOptions = opts
+}
+
+// walkFilter applies WalkOptions during a walk
+type walkFilter struct {
+	opts    *WalkOptions
+	wfs     walkFS
+	root    string
+	exclude []ignoreRule
+	rules   map[string][]ignoreRule // rules from ignore files by relative directory path ("" for root)
+}
+
+func newWalkFilter(opts *WalkOptions, wfs walkFS, root string) *walkFilter {
+	f := &walkFilter{opts: opts, wfs: wfs, root: root}
+	for _, p := range opts.Exclude {
+		if r, ok := parseIgnoreRule(p); ok {
+			f.exclude = append(f.exclude, r)
+		}
+	}
+	return f
+}
+
+// rel returns the slash-separated path of fpath relative to the root
+func (f *walkFilter) rel(fpath string) string {
+	root, p := filepath.ToSlash(filepath.Clean(f.root)), filepath.ToSlash(filepath.Clean(fpath))
+	if root == "." {
+		return strings.TrimPrefix(p, "./")
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(p, root), "/")
+}
+
+// check is called for each path walked, it returns true if fpath is a file which should be scanned,
+// or an error to return from the walk func (possibly filepath.SkipDir)
+func (f *walkFilter) check(fpath string, info os.FileInfo, err error) (bool, error) {
+
+	if err != nil {
+		if f.opts.ErrorFunc != nil {
+			err = f.opts.ErrorFunc(fpath, err)
+		}
+		if err == nil && info != nil && info.IsDir() {
+			err = filepath.SkipDir
+		}
+		return false, err
+	}
+
+	rel := f.rel(fpath)
+	isDir := info.IsDir()
+
+	if rel != "" && f.ignored(rel, isDir) {
+		if isDir {
+			return false, filepath.SkipDir
+		}
+		return false, nil
+	}
+
+	if isDir {
+		return false, f.readIgnoreFiles(fpath, rel)
+	}
+
+	if f.opts.MaxFileSize > 0 && info.Size() > f.opts.MaxFileSize {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+func (f *walkFilter) ignored(rel string, isDir bool) bool {
+	ignored := matchIgnoreRules(f.exclude, rel, isDir, false)
+	if len(f.rules) == 0 {
+		return ignored
+	}
+	// apply the rules from the ignore files in each parent directory, outermost first
+	parts := strings.Split(rel, "/")
+	for i := 0; i < len(parts); i++ {
+		dir := strings.Join(parts[:i], "/")
+		if rules := f.rules[dir]; len(rules) > 0 {
+			ignored = matchIgnoreRules(rules, strings.Join(parts[i:], "/"), isDir, ignored)
+		}
+	}
+	return ignored
+}
+
+func (f *walkFilter) readIgnoreFiles(fpath, rel string) error {
+	for _, name := range f.opts.IgnoreFiles {
+		rc, err := f.wfs.open(joinPath(f.wfs, fpath, name))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+		rules, err := readIgnoreRules(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		if f.rules == nil {
+			f.rules = make(map[string][]ignoreRule)
+		}
+		f.rules[rel] = append(f.rules[rel], rules...)
+	}
+	return nil
+}
+
+func joinPath(wfs walkFS, dir, name string) string {
+	if _, ok := wfs.(osWalkFS); ok {
+		return filepath.Join(dir, name)
+	}
+	return path.Join(dir, name)
+}
+
+// walk walks root on wfs, applying the WalkOptions, and calls fn for each file matching fnmatch
+func (s *Scanner) walk(wfs walkFS, root string, fnmatch func(fn string) bool, fn func(fpath string, info os.FileInfo) error) error {
+	if s.walkOptions.FollowSymlinks {
+		if _, ok := wfs.(osWalkFS); ok {
+			wfs = osWalkFS{followSymlinks: true}
+		}
+	}
+	f := newWalkFilter(&s.walkOptions, wfs, root)
+	return wfs.walk(root, func(fpath string, info os.FileInfo, err error) error {
+		ok, err := f.check(fpath, info, err)
+		if err != nil || !ok || !fnmatch(fpath) {
+			return err
+		}
+		return fn(fpath, info)
+	})
+}
+
+// peekBinary reports if the start of r looks like binary data, the returned
+// reader reads r from the beginning
+func peekBinary(r io.Reader) (io.Reader, bool, error) {
+	b := make([]byte, 512)
+	n, err := io.ReadFull(r, b)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, false, err
+	}
+	b = b[:n]
+	return io.MultiReader(bytes.NewReader(b), r), bytes.IndexByte(b, 0) >= 0, nil
+}